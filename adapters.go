@@ -0,0 +1,49 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Constructor returns the middleware as an alice.Constructor, for chains which end with router:
+//
+//	alice.New(middleware.Constructor(router), auth).Then(router)
+//
+// Requests served by a route of router are labelled with its template, and those rejected by the
+// middlewares further down the chain or matching no route are recorded as with InstrumentRouter.
+// router may be nil when the chain does not end with a gorilla/mux router.
+func (p *PrometheusMiddleware) Constructor(router *mux.Router) func(http.Handler) http.Handler {
+	if router != nil {
+		p.useCaptureRoute(router)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return p.instrument(next, instrumentation{captureRoutes: router != nil})
+	}
+}
+
+// NegroniHandler is the middleware as a negroni.Handler.
+type NegroniHandler struct {
+	p  *PrometheusMiddleware
+	in instrumentation
+}
+
+// NegroniHandler returns the middleware as a negroni.Handler, for stacks whose final handler is router:
+//
+//	n := negroni.New(middleware.NegroniHandler(router), auth)
+//	n.UseHandler(router)
+//
+// Requests are labelled as with Constructor. router may be nil when the stack does not end with a
+// gorilla/mux router.
+func (p *PrometheusMiddleware) NegroniHandler(router *mux.Router) NegroniHandler {
+	if router != nil {
+		p.useCaptureRoute(router)
+	}
+	return NegroniHandler{p: p, in: instrumentation{captureRoutes: router != nil}}
+}
+
+// ServeHTTP records the request served by next.
+func (h NegroniHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	h.p.serve(w, r, next, h.in)
+}
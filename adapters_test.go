@@ -0,0 +1,82 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_Constructor(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	// What alice.New(middleware.Constructor(r), passThrough).Then(r) builds.
+	handler := middleware.Constructor(r)(passThrough(r))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+
+	if got := readMetric(t, middleware.request.WithLabelValues("200", "get", "/users/{id}")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests = %v, want 1", got)
+	}
+}
+
+func Test_NegroniHandler(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	// What negroni calls for n := negroni.New(middleware.NegroniHandler(r)); n.UseHandler(r).
+	handler := middleware.NegroniHandler(r)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil), r.ServeHTTP)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil), r.ServeHTTP)
+
+	if got := readMetric(t, middleware.request.WithLabelValues("202", "get", "/users/{id}")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests of the route = %v, want 1", got)
+	}
+	if got := readMetric(t, middleware.request.WithLabelValues("404", "get", "not_found")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests matching no route = %v, want 1", got)
+	}
+}
+
+func Test_NegroniHandlerAllocations(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	negroni := middleware.NegroniHandler(nil)
+	instrumented := middleware.instrument(next, negroni.in)
+
+	w, r := httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil)
+	want := testing.AllocsPerRun(100, func() { instrumented.ServeHTTP(w, r) })
+	if got := testing.AllocsPerRun(100, func() { negroni.ServeHTTP(w, r, next) }); got > want {
+		t.Errorf("NegroniHandler allocates %v times per request, want at most the %v of an instrumented handler", got, want)
+	}
+}
+
+func Test_AdaptersCaptureRoutesOnce(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:         []prometheus.Registerer{prometheus.NewRegistry()},
+		TrackInFlightByPath: true,
+	})
+
+	r := mux.NewRouter()
+	var inFlight float64
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		inFlight = readMetric(t, middleware.concurrent.WithLabelValues("/users/{id}", "get")).GetGauge().GetValue()
+	})
+
+	// Several chains built for the same router, e.g. one per listener.
+	middleware.Constructor(r)
+	middleware.NegroniHandler(r)
+	handler := middleware.Constructor(r)(r)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+
+	if inFlight != 1 {
+		t.Errorf("in-flight requests while served = %v, want 1 from a single captureRoute", inFlight)
+	}
+}
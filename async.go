@@ -0,0 +1,119 @@
+package prometheusmiddleware
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// asyncRecorder records the observations of the requests on a background goroutine.
+type asyncRecorder struct {
+	observations chan *observation
+	dropped      prometheus.Counter
+	self         *selfMetrics
+
+	// mu is read-locked by the senders and locked once to stop, so that no observation can be
+	// sent after the recorder goroutine drained the buffer.
+	mu        sync.RWMutex
+	stopped   bool
+	closeOnce sync.Once
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+func newAsyncRecorder(opts Opts) *asyncRecorder {
+	return &asyncRecorder{
+		observations: make(chan *observation, opts.AsyncBufferSize),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        droppedName,
+			Help:        "How many request observations were dropped because the async buffer was full.",
+			Subsystem:   opts.Subsystem,
+			ConstLabels: opts.ConstLabels,
+		}),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// run records the observations until the recorder is stopped, then records those left in the buffer.
+func (a *asyncRecorder) run(record func(*observation)) {
+	defer close(a.done)
+
+	for {
+		select {
+		case o := <-a.observations:
+			record(o)
+		case <-a.quit:
+			for {
+				select {
+				case o := <-a.observations:
+					record(o)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send hands the observation to the recorder goroutine, dropping it when the buffer is full.
+// It reports false once the recorder is stopped, the caller then records the observation itself.
+func (a *asyncRecorder) send(o *observation) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.stopped {
+		return false
+	}
+
+	select {
+	case a.observations <- o:
+	default:
+		a.dropped.Inc()
+		a.self.drop()
+	}
+	return true
+}
+
+// stop stops the recorder goroutine once it has recorded the buffered observations,
+// or fails when the context is done first.
+func (a *asyncRecorder) stop(ctx context.Context) error {
+	a.closeOnce.Do(func() {
+		a.mu.Lock()
+		a.stopped = true
+		close(a.quit)
+		a.mu.Unlock()
+	})
+
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the background goroutines of the middleware. When recording asynchronously, the
+// observations left in the buffer are recorded first, and so are the slow request lines left to
+// log, and the error of the context is returned when it is done before. The requests served
+// afterwards are recorded and logged on their own goroutine. Shutdown can be called several times.
+func (p *PrometheusMiddleware) Shutdown(ctx context.Context) error {
+	if p.rate != nil {
+		p.rate.stop()
+	}
+	if p.async != nil {
+		if err := p.async.stop(ctx); err != nil {
+			return err
+		}
+	}
+	if p.slow != nil {
+		return p.slow.stop(ctx)
+	}
+	return nil
+}
+
+// Close is Shutdown without a deadline.
+func (p *PrometheusMiddleware) Close() error {
+	return p.Shutdown(context.Background())
+}
@@ -0,0 +1,129 @@
+package prometheusmiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_InstrumentAsync(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:     []prometheus.Registerer{prometheus.NewRegistry()},
+		AsyncBufferSize: 16,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for i := 0; i < 10; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if err := middleware.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got := readMetric(t, middleware.request.WithLabelValues("200", "get", "/")).GetCounter().GetValue(); got != 11 {
+		t.Errorf("requests = %v, want 11", got)
+	}
+}
+
+func Test_asyncRecorderDrops(t *testing.T) {
+	a := newAsyncRecorder(Opts{AsyncBufferSize: 1})
+	recording, release := make(chan struct{}), make(chan struct{})
+	recorded := 0
+	go a.run(func(*observation) {
+		if recorded == 0 {
+			close(recording)
+			<-release
+		}
+		recorded++
+	})
+
+	a.send(&observation{})
+	<-recording
+	a.send(&observation{}) // buffered
+	a.send(&observation{}) // dropped
+	close(release)
+	if err := a.stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if recorded != 2 {
+		t.Errorf("recorded %d observations, want 2", recorded)
+	}
+	if got := readMetric(t, a.dropped).GetCounter().GetValue(); got != 1 {
+		t.Errorf("dropped %v observations, want 1", got)
+	}
+}
+
+func Test_asyncRecorderStopWhileSending(t *testing.T) {
+	a := newAsyncRecorder(Opts{AsyncBufferSize: 4})
+	var recorded int64
+	go a.run(func(*observation) { atomic.AddInt64(&recorded, 1) })
+
+	const senders, sends = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				if !a.send(&observation{}) {
+					// Stopped: the caller records the observation itself.
+					atomic.AddInt64(&recorded, 1)
+				}
+			}
+		}()
+	}
+	if err := a.stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	dropped := readMetric(t, a.dropped).GetCounter().GetValue()
+	if got := float64(atomic.LoadInt64(&recorded)) + dropped; got != senders*sends {
+		t.Errorf("recorded %d and dropped %v observations, want %d in total", recorded, dropped, senders*sends)
+	}
+}
+
+func Test_Shutdown(t *testing.T) {
+	middleware := &PrometheusMiddleware{async: newAsyncRecorder(Opts{AsyncBufferSize: 1})}
+	recording, release := make(chan struct{}), make(chan struct{})
+	go middleware.async.run(func(*observation) {
+		close(recording)
+		<-release
+	})
+	middleware.async.send(&observation{})
+	<-recording
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := middleware.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() past the deadline = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := middleware.Shutdown(context.Background()); err != nil {
+			t.Errorf("Shutdown() = %v, want nil", err)
+		}
+	}
+	if err := (&PrometheusMiddleware{}).Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() in sync mode = %v, want nil", err)
+	}
+}
+
+func BenchmarkInstrumentHandlerDurationAsync(b *testing.B) {
+	benchmarkInstrumentHandlerDuration(b, Opts{AsyncBufferSize: 1024})
+}
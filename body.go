@@ -0,0 +1,49 @@
+package prometheusmiddleware
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// countingReadCloser counts the bytes read from the wrapped request body.
+type countingReadCloser struct {
+	io.ReadCloser
+	read int64
+}
+
+func (c *countingReadCloser) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.read += int64(n)
+	return n, err
+}
+
+// timedReadCloser records when the wrapped request body was first and last read.
+type timedReadCloser struct {
+	io.ReadCloser
+	now         func() time.Time
+	first, last time.Time
+}
+
+func (t *timedReadCloser) Read(b []byte) (int, error) {
+	if t.first.IsZero() {
+		t.first = t.now()
+	}
+	n, err := t.ReadCloser.Read(b)
+	t.last = t.now()
+	return n, err
+}
+
+// isMultipart reports whether the request body is a multipart message.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// isStreaming reports whether the response header announces server-sent events.
+func isStreaming(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
@@ -0,0 +1,39 @@
+package prometheusmiddleware
+
+import (
+	"math"
+	"time"
+)
+
+// DefaultLatencyBuckets returns the default buckets of the latency histograms, in seconds:
+// 50ms, 100ms, 300ms, 500ms, 1s, 2.5s and 5s.
+func DefaultLatencyBuckets() []float64 {
+	return append([]float64{}, dflBuckets...)
+}
+
+// DefaultSizeBuckets returns the default buckets of the size histograms, in bytes:
+// 100B, 1kB, 5kB, 20kB and 50kB.
+func DefaultSizeBuckets() []float64 {
+	return append([]float64{}, dflSizeBuckets...)
+}
+
+// DurationBuckets returns count exponential buckets from min to max, in seconds like the
+// latency histograms, e.g. DurationBuckets(time.Millisecond, time.Second, 4) returns 1ms,
+// 10ms, 100ms and 1s. It panics when count is less than 2 or min is not positive and less
+// than max, like prometheus.ExponentialBuckets panics on invalid arguments.
+func DurationBuckets(min, max time.Duration, count int) []float64 {
+	if count < 2 {
+		panic("DurationBuckets needs a count of 2 or more")
+	}
+	if min <= 0 || min >= max {
+		panic("DurationBuckets needs 0 < min < max")
+	}
+
+	factor := math.Pow(float64(max)/float64(min), 1/float64(count-1))
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = seconds(min) * math.Pow(factor, float64(i))
+	}
+	buckets[count-1] = seconds(max) // the exact upper bound, without rounding errors
+	return buckets
+}
@@ -0,0 +1,59 @@
+package prometheusmiddleware
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_DurationBuckets(t *testing.T) {
+	buckets := DurationBuckets(time.Millisecond, time.Second, 4)
+
+	want := []float64{0.001, 0.01, 0.1, 1}
+	if len(buckets) != len(want) {
+		t.Fatalf("DurationBuckets() = %v, want %v", buckets, want)
+	}
+	for i := range want {
+		if math.Abs(buckets[i]-want[i]) > 1e-12 {
+			t.Errorf("DurationBuckets()[%d] = %v, want %v", i, buckets[i], want[i])
+		}
+	}
+}
+
+func Test_bucketsAreIncreasing(t *testing.T) {
+	tests := map[string][]float64{
+		"DefaultLatencyBuckets": DefaultLatencyBuckets(),
+		"DefaultSizeBuckets":    DefaultSizeBuckets(),
+		"DurationBuckets":       DurationBuckets(5*time.Millisecond, 10*time.Second, 12),
+		"DurationBuckets of 2":  DurationBuckets(time.Millisecond, 3*time.Millisecond, 2),
+	}
+
+	for name, buckets := range tests {
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i] <= buckets[i-1] {
+				t.Errorf("%s = %v, not increasing at %d", name, buckets, i)
+			}
+		}
+	}
+}
+
+func Test_DefaultBucketsAreCopies(t *testing.T) {
+	DefaultLatencyBuckets()[0] = 42
+	DefaultSizeBuckets()[0] = 42
+	if dflBuckets[0] == 42 || dflSizeBuckets[0] == 42 {
+		t.Error("modifying the returned buckets modified the defaults")
+	}
+}
+
+func Test_DurationBucketsPanics(t *testing.T) {
+	for _, args := range [][3]int64{{0, 1, 3}, {2, 1, 3}, {1, 2, 1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("DurationBuckets(%v) did not panic", args)
+				}
+			}()
+			DurationBuckets(time.Duration(args[0]), time.Duration(args[1]), int(args[2]))
+		}()
+	}
+}
@@ -0,0 +1,124 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type capturedRouteKey struct{}
+
+// capturedRoute is the path label of the gorilla/mux route which served a request, captured
+// so that a middleware wrapping the router, rather than used by it, still labels the request
+// with the route template.
+type capturedRoute struct {
+	path     string
+	name     string
+	captured bool
+}
+
+// InstrumentRouter returns the router wrapped in the middlewares, applied in order, and instruments
+// it as a whole. Unlike with router.Use(InstrumentHandlerDuration), the requests which the
+// middlewares reject before they reach the router (e.g. 413 for oversized bodies), or which match
+// no route, are recorded too. The requests served by a route are labelled with its template, the
+// 404 and 405 responses without route with Opts.NotFoundPath and Opts.MethodNotAllowedPath, or the
+// 405 responses with the template of their route with Opts.ResolveMethodNotAllowedRoutes, and the
+// others with their URL path templated by Opts.AutoTemplatePatterns.
+func (p *PrometheusMiddleware) InstrumentRouter(router *mux.Router, middlewares ...mux.MiddlewareFunc) http.Handler {
+	p.useCaptureRoute(router)
+
+	var handler http.Handler = router
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return p.instrument(handler, instrumentation{captureRoutes: true, router: router})
+}
+
+// InstrumentUnmatched instruments the requests which match no route of the router, which
+// router.Use(InstrumentHandlerDuration) does not see. They are labelled with Opts.NotFoundPath,
+// or Opts.MethodNotAllowedPath when a route matched but not its methods, rather than with their
+// URL path. It replaces the NotFoundHandler and MethodNotAllowedHandler of the router by
+// instrumented ones, wrapping those already set, so it must be called after setting them.
+func (p *PrometheusMiddleware) InstrumentUnmatched(router *mux.Router) {
+	notFound := router.NotFoundHandler
+	if notFound == nil {
+		notFound = http.NotFoundHandler()
+	}
+	router.NotFoundHandler = p.instrument(notFound, instrumentation{path: p.opts.NotFoundPath})
+
+	methodNotAllowed := router.MethodNotAllowedHandler
+	if methodNotAllowed == nil {
+		methodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		})
+	}
+	router.MethodNotAllowedHandler = p.instrument(methodNotAllowed, instrumentation{path: p.opts.MethodNotAllowedPath, router: router})
+}
+
+// unmatchedPath returns the path label of a request without route given its status, or
+// "" when the status does not tell it is unmatched.
+func (p *PrometheusMiddleware) unmatchedPath(status int) string {
+	switch status {
+	case http.StatusNotFound:
+		return p.opts.NotFoundPath
+	case http.StatusMethodNotAllowed:
+		return p.opts.MethodNotAllowedPath
+	}
+	return ""
+}
+
+// standardMethods are the methods tried by methodMismatchTemplate.
+var standardMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace,
+}
+
+// methodMismatchTemplate returns the template of the route of the router which matches the
+// request but not its method, or "" when there is none. As the router does not tell which route
+// mismatched, the request is matched again with each standard method in turn.
+func methodMismatchTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match); match.MatchErr != mux.ErrMethodMismatch {
+		return ""
+	}
+
+	for _, method := range standardMethods {
+		if method == r.Method {
+			continue
+		}
+		probe := *r
+		probe.Method = method
+
+		var match mux.RouteMatch
+		if router.Match(&probe, &match) && match.MatchErr == nil && match.Route != nil {
+			template, err := match.Route.GetPathTemplate()
+			if err == nil {
+				return template
+			}
+		}
+	}
+	return ""
+}
+
+// useCaptureRoute adds captureRoute to the middlewares of router, once however many times the
+// router is instrumented.
+func (p *PrometheusMiddleware) useCaptureRoute(router *mux.Router) {
+	if _, loaded := p.capturing.LoadOrStore(router, struct{}{}); !loaded {
+		router.Use(p.captureRoute)
+	}
+}
+
+// captureRoute records the path label of the matched route for the instrumentation wrapping the router.
+func (p *PrometheusMiddleware) captureRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route, ok := r.Context().Value(capturedRouteKey{}).(*capturedRoute); ok {
+			route.path = p.resolvePath(r)
+			route.name = MuxRouteName(r)
+			route.captured = true
+			if p.concurrent != nil {
+				defer p.trackInFlight(r, route.path)()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,162 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// limitBody rejects the requests with a body larger than 8 bytes.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > 8 {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func passThrough(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+	})
+}
+
+func Test_InstrumentRejectedByInnerMiddleware(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration, passThrough, limitBody, passThrough)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/users/42", strings.NewReader("a large body")))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/users/42", strings.NewReader("small")))
+
+	for code, want := range map[string]float64{"413": 1, "200": 1} {
+		if got := readMetric(t, middleware.request.WithLabelValues(code, "put", "/users/{id}")).GetCounter().GetValue(); got != want {
+			t.Errorf("%s requests = %v, want %v", code, got, want)
+		}
+	}
+}
+
+func Test_InstrumentRouter(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := middleware.InstrumentRouter(r, passThrough, limitBody)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/users/42", strings.NewReader("a large body")))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/users/42", strings.NewReader("small")))
+
+	tests := []struct {
+		code, path string
+	}{
+		{"413", "/users/:id"},
+		{"204", "/users/{id}"},
+	}
+	for _, tt := range tests {
+		if got := readMetric(t, middleware.request.WithLabelValues(tt.code, "put", tt.path)).GetCounter().GetValue(); got != 1 {
+			t.Errorf("%s requests of %s = %v, want 1", tt.code, tt.path, got)
+		}
+	}
+}
+
+func Test_InstrumentUnmatched(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:  []prometheus.Registerer{prometheus.NewRegistry()},
+		NotFoundPath: "unmatched",
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	r.Use(middleware.InstrumentHandlerDuration)
+	middleware.InstrumentUnmatched(r)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/wp-admin/login.php", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/users/42", nil))
+
+	tests := []struct {
+		code, method, path string
+	}{
+		{"200", "get", "/users/{id}"},
+		{"404", "get", "unmatched"},
+		{"405", "delete", "method_not_allowed"},
+	}
+	for _, tt := range tests {
+		if got := readMetric(t, middleware.request.WithLabelValues(tt.code, tt.method, tt.path)).GetCounter().GetValue(); got != 1 {
+			t.Errorf("%s requests of %s = %v, want 1", tt.code, tt.path, got)
+		}
+	}
+}
+
+func Test_InstrumentRouterUnmatched(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	handler := middleware.InstrumentRouter(r)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/wp-admin/login.php", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/users/42", nil))
+
+	if got := readMetric(t, middleware.request.WithLabelValues("404", "get", "not_found")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("not found requests = %v, want 1", got)
+	}
+	if got := readMetric(t, middleware.request.WithLabelValues("405", "delete", "method_not_allowed")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("method not allowed requests = %v, want 1", got)
+	}
+}
+
+func Test_InstrumentResolveMethodNotAllowedRoutes(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:                   []prometheus.Registerer{prometheus.NewRegistry()},
+		ResolveMethodNotAllowedRoutes: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("PUT")
+	handler := middleware.InstrumentRouter(r)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/users/42", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/orders/7", nil))
+
+	tests := []struct {
+		method, path string
+	}{
+		{"delete", "/users/{id}"},
+		{"get", "/api/orders/{id}"},
+	}
+	for _, tt := range tests {
+		if got := readMetric(t, middleware.request.WithLabelValues("405", tt.method, tt.path)).GetCounter().GetValue(); got != 1 {
+			t.Errorf("405 requests of %s = %v, want 1", tt.path, got)
+		}
+	}
+}
+
+func Test_InstrumentUnmatchedResolveMethodNotAllowedRoutes(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:                   []prometheus.Registerer{prometheus.NewRegistry()},
+		ResolveMethodNotAllowedRoutes: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	middleware.InstrumentUnmatched(r)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/users/42", nil))
+
+	if got := readMetric(t, middleware.request.WithLabelValues("405", "delete", "/users/{id}")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("405 requests of /users/{id} = %v, want 1", got)
+	}
+}
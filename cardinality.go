@@ -0,0 +1,152 @@
+package prometheusmiddleware
+
+import (
+	"github.com/gorilla/mux"
+)
+
+// EstimateCardinality returns the estimated number of series the main metrics of the middleware
+// can reach for the routes of the router, assuming each route answers with every assumedCodes.
+// It is the sum of EstimateCardinalityByMetric.
+func (p *PrometheusMiddleware) EstimateCardinality(router *mux.Router, assumedCodes []string) int {
+	total := 0
+	for _, series := range p.EstimateCardinalityByMetric(router, assumedCodes) {
+		total += series
+	}
+	return total
+}
+
+// EstimateCardinalityByMetric returns the estimated number of series per metric name, without
+// namespace and subsystem, for the routes of the router, assuming each route answers with every
+// assumedCodes. A route counts once per method it declares, or once without methods, and each
+// enabled label multiplies the series by the number of values it can take. The labels returned
+// by functions, like OperationLabelFunc, are counted as one value per route, so the estimate is
+// a lower bound when they vary. Histograms count a series per bucket, plus +Inf, _sum and _count.
+// It is a planning tool: it walks the router, without serving any request.
+func (p *PrometheusMiddleware) EstimateCardinalityByMetric(router *mux.Router, assumedCodes []string) map[string]int {
+	base := routeMethods(router) * len(assumedCodes)
+
+	latencyBuckets := p.opts.Buckets
+	if len(latencyBuckets) == 0 {
+		latencyBuckets = dflBuckets
+	}
+	latency := histogramSeries(latencyBuckets)
+
+	estimate := map[string]int{
+		requestName:      base * p.labelValueCounts(p.requestLabels),
+		latencyName:      base * p.labelValueCounts(p.latencyLabels) * latency,
+		requestSizeName:  base * sizeSeries(sizeObserver(p.opts, p.opts.RequestSizeObserver)),
+		responseSizeName: base * p.labelValueCounts(p.resSizeLabels) * sizeSeries(sizeObserver(p.opts, p.opts.ResponseSizeObserver)),
+	}
+
+	if p.latencyMs != nil {
+		estimate[latencyMillisName] = estimate[latencyName]
+	}
+	if p.latencySum != nil {
+		objectives := p.opts.LatencySummaryObjectives
+		if len(objectives) == 0 {
+			objectives = dflLatencyObjectives
+		}
+		estimate[latencySummaryName] = base * p.labelValueCounts(p.latencyLabels) * summarySeries(objectives)
+	}
+	if p.ttfb != nil {
+		estimate[ttfbName] = base * latency
+	}
+	if p.headers != nil {
+		estimate[headersTimeName] = base * latency
+	}
+	if p.slack != nil {
+		estimate[deadlineSlackName] = base * histogramSeries(overrunBuckets(latencyBuckets))
+	}
+	if p.bodyRead != nil {
+		estimate[bodyReadName] = base * latency
+	}
+	if p.sizeRatio != nil {
+		estimate[sizeRatioName] = base * histogramSeries(dflRatioBuckets)
+	}
+	return estimate
+}
+
+// routeMethods returns the number of route and method pairs of the router, counting a route
+// without methods once. Routes without path template, like subrouter mounts, are skipped.
+func routeMethods(router *mux.Router) int {
+	pairs := 0
+	_ = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if _, err := route.GetPathTemplate(); err != nil || route.GetHandler() == nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil || len(methods) == 0 {
+			pairs++
+		} else {
+			pairs += len(methods)
+		}
+		return nil
+	})
+	return pairs
+}
+
+// labelValueCounts returns the product of the number of values the labels beyond the
+// default ones can take.
+func (p *PrometheusMiddleware) labelValueCounts(labels []string) int {
+	product := 1
+	for _, label := range labels[len(defaultLabels):] {
+		product *= p.labelValueCount(label)
+	}
+	return product
+}
+
+// labelValueCount returns the number of values an optional label can take, or 1 when it
+// is not bounded by the middleware itself.
+func (p *PrometheusMiddleware) labelValueCount(label string) int {
+	for _, query := range p.queries {
+		if query.name == label {
+			return len(query.values) + 2 // "other" and "none"
+		}
+	}
+
+	switch label {
+	case "conditional", "slow", "compressed", "warmup":
+		return 2
+	case "feature":
+		return 3 // on, off and absent
+	case "cache":
+		return 4 // HIT, MISS, other and none
+	case "circuit":
+		return 4 // open, half_open, other and none
+	case "proto", "accept":
+		return 5
+	case "encoding":
+		return 6 // identity, gzip, br, deflate, zstd and other
+	case "region":
+		return len(p.opts.Regions) + 1 // unknown
+	default:
+		return 1
+	}
+}
+
+// histogramSeries returns the number of series of a histogram with the buckets.
+func histogramSeries(buckets []float64) int {
+	return len(buckets) + 3 // +Inf, _sum and _count
+}
+
+// summarySeries returns the number of series of a summary with the objectives.
+func summarySeries(objectives map[float64]float64) int {
+	return len(objectives) + 2 // _sum and _count
+}
+
+// sizeSeries returns the number of series of a size collector configured by the observer.
+func sizeSeries(observer SizeObserver) int {
+	if observer.Summary {
+		objectives := observer.Objectives
+		if len(objectives) == 0 {
+			objectives = dflSizeObjectives
+		}
+		return summarySeries(objectives)
+	}
+
+	buckets := observer.Buckets
+	if len(buckets) == 0 {
+		buckets = dflSizeBuckets
+	}
+	return histogramSeries(buckets)
+}
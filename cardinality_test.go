@@ -0,0 +1,62 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func cardinalityRouter() *mux.Router {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", handler).Methods("GET")
+	r.HandleFunc("/orders", handler).Methods("GET", "POST")
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/health", handler)
+	return r
+}
+
+func Test_EstimateCardinality(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+
+	// 4 route and method pairs answering 2 codes.
+	got := middleware.EstimateCardinalityByMetric(cardinalityRouter(), []string{"200", "404"})
+	want := map[string]int{
+		requestName:      8,
+		latencyName:      8 * 10,
+		requestSizeName:  8 * 8,
+		responseSizeName: 8 * 8,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EstimateCardinalityByMetric() = %v, want %v", got, want)
+	}
+	if total := middleware.EstimateCardinality(cardinalityRouter(), []string{"200", "404"}); total != 216 {
+		t.Errorf("EstimateCardinality() = %d, want 216", total)
+	}
+}
+
+func Test_EstimateCardinalityOptionalLabels(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:        []prometheus.Registerer{prometheus.NewRegistry()},
+		FeatureFlagHeader:  "X-Feature-Flag",
+		QueryParamLabels:   []string{"type"},
+		QueryParamValues:   map[string][]string{"type": {"image", "video"}},
+		TrackTimeToHeaders: true,
+	})
+
+	got := middleware.EstimateCardinalityByMetric(cardinalityRouter(), []string{"200"})
+	// 4 route and method pairs, times 3 feature values and 4 query values.
+	if got[requestName] != 4*3*4 {
+		t.Errorf("%s = %d, want %d", requestName, got[requestName], 4*3*4)
+	}
+	if got[latencyName] != 4*3*4*10 {
+		t.Errorf("%s = %d, want %d", latencyName, got[latencyName], 4*3*4*10)
+	}
+	if got[headersTimeName] != 4*10 {
+		t.Errorf("%s = %d, want %d", headersTimeName, got[headersTimeName], 4*10)
+	}
+}
@@ -0,0 +1,81 @@
+package prometheusmiddleware
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+type decompressedSizeKey struct{}
+
+// DecompressedSize holds the size of the decompressed request body, which only the handler
+// decompressing it knows: the Content-Length of a gzip-encoded body is its compressed size.
+// The middleware puts one in the context of every request when Opts.TrackDecompressedRequestSize
+// is set and observes the reported size once the handler returns. Requests whose handler reported
+// nothing are not observed. Its methods are safe to call on a nil DecompressedSize, which records
+// nothing.
+type DecompressedSize struct {
+	mu       sync.Mutex
+	size     int64
+	reported bool
+}
+
+// DecompressedSizeFromContext returns the DecompressedSize of the request context, or nil.
+func DecompressedSizeFromContext(ctx context.Context) *DecompressedSize {
+	s, _ := ctx.Value(decompressedSizeKey{}).(*DecompressedSize)
+	return s
+}
+
+// Set reports n as the decompressed size of the request body.
+func (s *DecompressedSize) Set(n int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.size, s.reported = n, true
+	s.mu.Unlock()
+}
+
+// Add adds n to the decompressed size of the request body.
+func (s *DecompressedSize) Add(n int64) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.size += n
+	s.reported = true
+	s.mu.Unlock()
+}
+
+// Reader returns a reader adding the bytes read from r, the decompressed body like a
+// gzip.Reader of the request body, to the decompressed size. Only the bytes the handler
+// reads are counted. It returns r itself on a nil DecompressedSize.
+func (s *DecompressedSize) Reader(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	s.Add(0)
+	return &decompressedReader{Reader: r, size: s}
+}
+
+// value returns the reported size, or false when the handler reported nothing.
+func (s *DecompressedSize) value() (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size, s.reported
+}
+
+// decompressedReader adds the bytes read from the wrapped reader to a DecompressedSize.
+type decompressedReader struct {
+	io.Reader
+	size *DecompressedSize
+}
+
+func (d *decompressedReader) Read(b []byte) (int, error) {
+	n, err := d.Reader.Read(b)
+	d.size.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,78 @@
+package prometheusmiddleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_InstrumentDecompressedRequestSize(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:                  []prometheus.Registerer{prometheus.NewRegistry()},
+		TrackDecompressedRequestSize: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(DecompressedSizeFromContext(r.Context()).Reader(body)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	r.HandleFunc("/reported", func(w http.ResponseWriter, r *http.Request) {
+		DecompressedSizeFromContext(r.Context()).Set(4096)
+	})
+	r.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	payload := strings.Repeat("compressible ", 1000)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(payload))
+	zw.Close()
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", &compressed))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/reported", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/plain", nil))
+
+	tests := []struct {
+		path  string
+		count uint64
+		sum   float64
+	}{
+		{path: "/upload", count: 1, sum: float64(len(payload))},
+		{path: "/reported", count: 1, sum: 4096},
+		{path: "/plain", count: 0, sum: 0},
+	}
+	for _, tt := range tests {
+		histogram := readMetric(t, middleware.inflated.WithLabelValues("200", "post", tt.path).(prometheus.Metric)).GetHistogram()
+		if histogram.GetSampleCount() != tt.count || histogram.GetSampleSum() != tt.sum {
+			t.Errorf("%s decompressed size = %d observations summing to %v, want %d summing to %v",
+				tt.path, histogram.GetSampleCount(), histogram.GetSampleSum(), tt.count, tt.sum)
+		}
+	}
+}
+
+func Test_DecompressedSizeNil(t *testing.T) {
+	var s *DecompressedSize
+	s.Set(1)
+	s.Add(1)
+
+	body := strings.NewReader("body")
+	if reader := s.Reader(body); reader != body {
+		t.Error("Reader of a nil DecompressedSize wraps the body")
+	}
+	if DecompressedSizeFromContext(httptest.NewRequest("GET", "/", nil).Context()) != nil {
+		t.Error("DecompressedSizeFromContext returns a DecompressedSize outside the middleware")
+	}
+}
@@ -0,0 +1,189 @@
+package prometheusmiddleware
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// digestCompression bounds the number of centroids of a digest to about half its value.
+	digestCompression = 200
+	// digestBufferSize is the number of observations buffered before being merged into the centroids.
+	digestBufferSize = 2 * digestCompression
+)
+
+// digestQuantiles are the quantiles exposed by the quantileCollector.
+var digestQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+// centroid is a cluster of observations of a t-digest, summarized by their mean and count.
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+// tdigest is a merging t-digest, estimating quantiles within bounded memory with more accuracy
+// at the tails, where the high percentiles are. It is not safe for concurrent use.
+type tdigest struct {
+	centroids []centroid // sorted by mean
+	buffer    []centroid // observations not merged yet
+	total     float64    // count of the merged observations
+	min, max  float64
+}
+
+func newTDigest() *tdigest {
+	return &tdigest{
+		buffer: make([]centroid, 0, digestBufferSize),
+		min:    math.Inf(1),
+		max:    math.Inf(-1),
+	}
+}
+
+// add records an observation, merging the buffered ones once the buffer is full.
+func (d *tdigest) add(x float64) {
+	d.buffer = append(d.buffer, centroid{mean: x, count: 1})
+	d.min, d.max = math.Min(d.min, x), math.Max(d.max, x)
+	if len(d.buffer) == cap(d.buffer) {
+		d.merge()
+	}
+}
+
+// merge folds the buffered observations into the centroids, allowing each centroid as much
+// weight as the k1 scale function permits at its quantile.
+func (d *tdigest) merge() {
+	if len(d.buffer) == 0 {
+		return
+	}
+
+	all := append(d.buffer, d.centroids...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	total := d.total + float64(len(d.buffer))
+
+	merged := make([]centroid, 0, digestCompression/2)
+	current := all[0]
+	var soFar float64
+	limit := total * digestQuantile(digestScale(0)+1)
+	for _, c := range all[1:] {
+		if soFar+current.count+c.count <= limit {
+			current.count += c.count
+			current.mean += (c.mean - current.mean) * c.count / current.count
+			continue
+		}
+		soFar += current.count
+		merged = append(merged, current)
+		limit = total * digestQuantile(digestScale(soFar/total)+1)
+		current = c
+	}
+	d.centroids = append(merged, current)
+	d.total = total
+	d.buffer = d.buffer[:0]
+}
+
+// quantile returns the estimated q quantile, interpolated between the centers of the centroids,
+// or NaN when nothing was observed.
+func (d *tdigest) quantile(q float64) float64 {
+	d.merge()
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return d.min
+	}
+	if q >= 1 {
+		return d.max
+	}
+
+	target := q * d.total
+	first := d.centroids[0]
+	if target < first.count/2 {
+		return d.min + (first.mean-d.min)*target/(first.count/2)
+	}
+
+	cumulative := first.count / 2
+	for i := 0; i < len(d.centroids)-1; i++ {
+		a, b := d.centroids[i], d.centroids[i+1]
+		step := (a.count + b.count) / 2
+		if target < cumulative+step {
+			return a.mean + (b.mean-a.mean)*(target-cumulative)/step
+		}
+		cumulative += step
+	}
+
+	last := d.centroids[len(d.centroids)-1]
+	return last.mean + (d.max-last.mean)*math.Min(1, (target-cumulative)/(last.count/2))
+}
+
+// digestScale is the k1 scale function of the t-digest, mapping a quantile to its index.
+func digestScale(q float64) float64 {
+	return digestCompression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// digestQuantile is the inverse of digestScale.
+func digestQuantile(k float64) float64 {
+	if k >= digestCompression/4 {
+		return 1
+	}
+	return (math.Sin(k*2*math.Pi/digestCompression) + 1) / 2
+}
+
+// lockedDigest is the digest of a path, guarded by its own lock.
+type lockedDigest struct {
+	sync.Mutex
+	digest *tdigest
+}
+
+// quantileCollector exposes the latency quantiles estimated per path by a t-digest.
+type quantileCollector struct {
+	desc  *prometheus.Desc
+	paths sync.Map // path label -> *lockedDigest
+}
+
+func newQuantileCollector(opts Opts) *quantileCollector {
+	return &quantileCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, latencyQuantileName),
+			"The estimated quantiles of the time it took to process a request since the start, partitioned by HTTP path and quantile.",
+			[]string{"path", "quantile"},
+			opts.ConstLabels,
+		),
+	}
+}
+
+// observe records the latency of a request into the digest of its path.
+func (c *quantileCollector) observe(path string, seconds float64) {
+	v, ok := c.paths.Load(path)
+	if !ok {
+		v, _ = c.paths.LoadOrStore(path, &lockedDigest{digest: newTDigest()})
+	}
+	d := v.(*lockedDigest)
+
+	d.Lock()
+	d.digest.add(seconds)
+	d.Unlock()
+}
+
+// Describe implements prometheus.Collector.
+func (c *quantileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *quantileCollector) Collect(ch chan<- prometheus.Metric) {
+	c.paths.Range(func(path, v interface{}) bool {
+		d := v.(*lockedDigest)
+		values := make([]float64, len(digestQuantiles))
+		d.Lock()
+		for i, q := range digestQuantiles {
+			values[i] = d.digest.quantile(q)
+		}
+		d.Unlock()
+
+		for i, q := range digestQuantiles {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, values[i], path.(string), strconv.FormatFloat(q, 'f', -1, 64))
+		}
+		return true
+	})
+}
@@ -0,0 +1,81 @@
+package prometheusmiddleware
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_tdigest(t *testing.T) {
+	d := newTDigest()
+	if q := d.quantile(0.5); !math.IsNaN(q) {
+		t.Errorf("quantile of an empty digest = %v, want NaN", q)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	values := make([]float64, 100000)
+	for i := range values {
+		values[i] = random.ExpFloat64()
+		d.add(values[i])
+	}
+	sort.Float64s(values)
+
+	if len(d.centroids) > digestCompression {
+		t.Errorf("digest has %d centroids, want at most %d", len(d.centroids), digestCompression)
+	}
+	for _, q := range digestQuantiles {
+		want := values[int(q*float64(len(values)))]
+		if got := d.quantile(q); math.Abs(got-want)/want > 0.02 {
+			t.Errorf("quantile(%v) = %v, want %v within 2%%", q, got, want)
+		}
+	}
+	if got := d.quantile(0); got != values[0] {
+		t.Errorf("quantile(0) = %v, want the minimum %v", got, values[0])
+	}
+	if got := d.quantile(1); got != values[len(values)-1] {
+		t.Errorf("quantile(1) = %v, want the maximum %v", got, values[len(values)-1])
+	}
+}
+
+func Test_quantileCollector(t *testing.T) {
+	c := newQuantileCollector(Opts{})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+
+	for i := 1; i <= 1000; i++ {
+		c.observe("/users", float64(i)/1000)
+	}
+	c.observe("/orders", 0.3)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quantiles := make(map[string]map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if quantiles[labels["path"]] == nil {
+				quantiles[labels["path"]] = make(map[string]float64)
+			}
+			quantiles[labels["path"]][labels["quantile"]] = metric.GetGauge().GetValue()
+		}
+	}
+
+	want := map[string]float64{"0.5": 0.5, "0.9": 0.9, "0.99": 0.99, "0.999": 0.999}
+	for quantile, value := range want {
+		if got := quantiles["/users"][quantile]; math.Abs(got-value) > 0.01 {
+			t.Errorf("/users quantile %s = %v, want %v", quantile, got, value)
+		}
+		if got := quantiles["/orders"][quantile]; got != 0.3 {
+			t.Errorf("/orders quantile %s = %v, want 0.3", quantile, got)
+		}
+	}
+}
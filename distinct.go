@@ -0,0 +1,87 @@
+package prometheusmiddleware
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// distinctPrecision is the number of hash bits selecting the register of a key. Its 2^14
+// registers take 16KiB and give a standard error of 1.04/sqrt(2^14), about 0.8%.
+const distinctPrecision = 14
+
+// distinctCounter estimates the number of distinct client keys with a HyperLogLog, in constant
+// memory whatever the number of clients.
+type distinctCounter struct {
+	gauge prometheus.GaugeFunc
+
+	mu        sync.Mutex
+	registers []uint8
+}
+
+func newDistinctCounter(opts Opts) *distinctCounter {
+	c := &distinctCounter{registers: make([]uint8, 1<<distinctPrecision)}
+	c.gauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Name:        distinctClientsName,
+			Help:        "Estimate of how many distinct clients sent HTTP requests since the start.",
+			Subsystem:   opts.Subsystem,
+			ConstLabels: opts.ConstLabels,
+		},
+		c.estimate,
+	)
+	return c
+}
+
+// add counts the key, once whatever the number of times it is added.
+func (c *distinctCounter) add(key string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := mix(hash.Sum64())
+
+	register := sum >> (64 - distinctPrecision)
+	rank := uint8(bits.LeadingZeros64(sum<<distinctPrecision|1<<(distinctPrecision-1)) + 1)
+
+	c.mu.Lock()
+	if rank > c.registers[register] {
+		c.registers[register] = rank
+	}
+	c.mu.Unlock()
+}
+
+// estimate returns the estimated number of distinct keys added.
+func (c *distinctCounter) estimate() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := float64(len(c.registers))
+	var sum float64
+	var zeros int
+	for _, rank := range c.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Round(estimate)
+}
+
+// mix spreads the bits of the FNV hash, whose high bits are poorly distributed for short keys.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
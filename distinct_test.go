@@ -0,0 +1,53 @@
+package prometheusmiddleware
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_distinctCounter(t *testing.T) {
+	c := newDistinctCounter(Opts{})
+
+	for _, key := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.3", "10.0.0.2"} {
+		c.add(key)
+	}
+	if got := c.estimate(); got != 3 {
+		t.Errorf("estimate() = %v, want 3", got)
+	}
+
+	for i := 0; i < 100000; i++ {
+		c.add("client-" + strconv.Itoa(i%50000))
+	}
+	if got := c.estimate(); math.Abs(got-50003)/50003 > 0.03 {
+		t.Errorf("estimate() = %v, want 50003 within 3%%", got)
+	}
+}
+
+func Test_InstrumentDistinctClients(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		DistinctClientKeyFunc: func(r *http.Request) string {
+			return r.Header.Get("X-Api-Key")
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for _, key := range []string{"alice", "bob", "alice", ""} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Api-Key", key)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if got := readMetric(t, middleware.clients.gauge).GetGauge().GetValue(); got != 2 {
+		t.Errorf("distinct clients = %v, want 2", got)
+	}
+}
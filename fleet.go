@@ -0,0 +1,26 @@
+package prometheusmiddleware
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serviceLabel is the const label identifying the service of a fleet middleware.
+const serviceLabel = "service"
+
+// NewFleetMiddleware creates a PrometheusMiddleware whose metrics aggregate across the
+// services of a fleet: every metric carries a "service" const label, and the Subsystem
+// is cleared so that every service exposes the same metric names. The Namespace, if
+// any, is meant to be shared by the whole fleet.
+func NewFleetMiddleware(service string, opts Opts) *PrometheusMiddleware {
+	constLabels := prometheus.Labels{serviceLabel: service}
+	for name, value := range opts.ConstLabels {
+		if name != serviceLabel {
+			constLabels[name] = value
+		}
+	}
+
+	opts.ConstLabels = constLabels
+	opts.Subsystem = ""
+
+	return NewPrometheusMiddleware(opts)
+}
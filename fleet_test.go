@@ -0,0 +1,46 @@
+package prometheusmiddleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func ExampleNewFleetMiddleware() {
+	registry := prometheus.NewRegistry()
+
+	for _, service := range []string{"checkout", "inventory"} {
+		middleware := NewFleetMiddleware(service, Opts{
+			Namespace:   "shop",
+			Registerers: []prometheus.Registerer{registry},
+		})
+
+		r := mux.NewRouter()
+		r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		r.Use(middleware.InstrumentHandlerDuration)
+
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	families, _ := registry.Gather()
+	for _, family := range families {
+		if family.GetName() != "shop_"+requestName {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == serviceLabel {
+					fmt.Println(family.GetName(), label.GetValue(), metric.GetCounter().GetValue())
+				}
+			}
+		}
+	}
+	// Output:
+	// shop_http_requests_total checkout 1
+	// shop_http_requests_total inventory 1
+}
@@ -0,0 +1,34 @@
+package prometheusmiddleware
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteHandlerName returns the name of the handler of the gorilla/mux route matched
+// by the request: the function name for http.HandlerFunc, the type name otherwise.
+// It is meant to be used as Opts.HandlerNameFunc. It returns "" when no route matched.
+func RouteHandlerName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+
+	return handlerName(route.GetHandler())
+}
+
+func handlerName(handler http.Handler) string {
+	switch h := handler.(type) {
+	case nil:
+		return ""
+	case http.HandlerFunc:
+		if fn := runtime.FuncForPC(reflect.ValueOf(h).Pointer()); fn != nil {
+			return fn.Name()
+		}
+	}
+	return fmt.Sprintf("%T", handler)
+}
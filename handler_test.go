@@ -0,0 +1,61 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+type metricsHandler struct{}
+
+func (metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {}
+
+func Test_RouteHandlerName(t *testing.T) {
+	var names []string
+	capture := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			names = append(names, RouteHandlerName(r))
+		})
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", listUsers)
+	r.Handle("/metrics", metricsHandler{})
+	r.Use(capture)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	names = append(names, RouteHandlerName(httptest.NewRequest("GET", "/", nil)))
+
+	want := []string{"github.com/spl0i7/prometheus-middleware.listUsers", "prometheusmiddleware.metricsHandler", ""}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("RouteHandlerName() = %q, want %q", names[i], want[i])
+		}
+	}
+}
+
+func Test_InstrumentHandlerName(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:     []prometheus.Registerer{prometheus.NewRegistry()},
+		HandlerNameFunc: RouteHandlerName,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", listUsers)
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	name := "github.com/spl0i7/prometheus-middleware.listUsers"
+	if counter := readMetric(t, middleware.request.WithLabelValues("200", "get", "/users", name)).GetCounter(); counter.GetValue() != 1 {
+		t.Errorf("request count = %v, want 1", counter.GetValue())
+	}
+}
@@ -0,0 +1,80 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// pathFilter tells which requests must not be instrumented.
+type pathFilter struct {
+	paths    map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+func newPathFilter(opts Opts) *pathFilter {
+	f := &pathFilter{paths: make(map[string]struct{}, len(opts.IgnorePaths))}
+
+	for _, path := range opts.IgnorePaths {
+		f.paths[path] = struct{}{}
+	}
+
+	for _, pattern := range opts.IgnorePathPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			opts.logger().Println("ignored path pattern was not compiled:", err)
+			continue
+		}
+		f.patterns = append(f.patterns, re)
+	}
+
+	return f
+}
+
+// ignored reports whether the request, whose path label is path, must not be instrumented.
+// Exact paths are looked up first, then the patterns are matched in order. Both the path
+// label and the URL path are considered.
+func (f *pathFilter) ignored(r *http.Request, path string) bool {
+	if _, ok := f.paths[path]; ok {
+		return true
+	}
+	if _, ok := f.paths[r.URL.Path]; ok {
+		return true
+	}
+
+	for _, re := range f.patterns {
+		if re.MatchString(path) || re.MatchString(r.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeAllowList holds the routes which are instrumented, as configured by Opts.RouteAllowList.
+// A nil routeAllowList allows every route.
+type routeAllowList map[string]struct{}
+
+func newRouteAllowList(routes []string) routeAllowList {
+	if len(routes) == 0 {
+		return nil
+	}
+
+	allowed := make(routeAllowList, len(routes))
+	for _, route := range routes {
+		allowed[route] = struct{}{}
+	}
+	return allowed
+}
+
+// allowed reports whether any of the identities of a route, like its template or name, is allowed.
+func (a routeAllowList) allowed(identities ...string) bool {
+	if a == nil {
+		return true
+	}
+
+	for _, identity := range identities {
+		if _, ok := a[identity]; ok && identity != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_pathFilter(t *testing.T) {
+	f := newPathFilter(Opts{
+		IgnorePaths:        []string{"/health"},
+		IgnorePathPatterns: []string{`^/static/`, `^/debug/pprof(/.*)?$`, `[`},
+	})
+
+	tests := []struct {
+		path    string
+		url     string
+		ignored bool
+	}{
+		{path: "/health", url: "/health", ignored: true},
+		{path: "/healthz", url: "/healthz", ignored: false},
+		{path: "/static/{file:.*}", url: "/static/css/site.css", ignored: true},
+		{path: "", url: "/debug/pprof/heap", ignored: true},
+		{path: "/debug/pprof", url: "/debug/pprof", ignored: true},
+		{path: "/users/{id}", url: "/users/42", ignored: false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if got := f.ignored(r, tt.path); got != tt.ignored {
+			t.Errorf("ignored(%q, %q) = %v, want %v", tt.url, tt.path, got, tt.ignored)
+		}
+	}
+}
+
+func Test_routeAllowList(t *testing.T) {
+	if !newRouteAllowList(nil).allowed("/anything") {
+		t.Error("an empty allow-list does not allow every route")
+	}
+
+	a := newRouteAllowList([]string{"/users/{id}", "orders"})
+	tests := []struct {
+		identities []string
+		allowed    bool
+	}{
+		{identities: []string{"/users/{id}", ""}, allowed: true},
+		{identities: []string{"/orders", "orders"}, allowed: true},
+		{identities: []string{"/health", ""}, allowed: false},
+		{identities: []string{"", ""}, allowed: false},
+	}
+	for _, tt := range tests {
+		if got := a.allowed(tt.identities...); got != tt.allowed {
+			t.Errorf("allowed(%q) = %v, want %v", tt.identities, got, tt.allowed)
+		}
+	}
+}
+
+func allowListRouter() (*mux.Router, *int) {
+	served := 0
+	handler := func(w http.ResponseWriter, r *http.Request) { served++ }
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", handler)
+	r.HandleFunc("/orders", handler).Name("orders")
+	r.HandleFunc("/orders/export", handler)
+	r.HandleFunc("/health", handler)
+	return r, &served
+}
+
+func Test_InstrumentRouteAllowList(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:    []prometheus.Registerer{prometheus.NewRegistry()},
+		RouteAllowList: []string{"/users/{id}", "orders", "/orders/export"},
+		IgnorePaths:    []string{"/orders/export"},
+	})
+
+	r, served := allowListRouter()
+	r.Use(middleware.InstrumentHandlerDuration)
+	for _, target := range []string{"/users/1", "/orders", "/orders/export", "/health"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	if *served != 4 {
+		t.Errorf("served %d requests, want 4", *served)
+	}
+	assertAllowedRoutes(t, middleware)
+}
+
+func Test_InstrumentRouterRouteAllowList(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:    []prometheus.Registerer{prometheus.NewRegistry()},
+		RouteAllowList: []string{"/users/{id}", "orders", "/orders/export"},
+		IgnorePaths:    []string{"/orders/export"},
+	})
+
+	r, served := allowListRouter()
+	handler := middleware.InstrumentRouter(r)
+	for _, target := range []string{"/users/1", "/orders", "/orders/export", "/health"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	if *served != 4 {
+		t.Errorf("served %d requests, want 4", *served)
+	}
+	assertAllowedRoutes(t, middleware)
+}
+
+// assertAllowedRoutes checks that only the allowed routes which are not ignored were recorded.
+func assertAllowedRoutes(t *testing.T, middleware *PrometheusMiddleware) {
+	t.Helper()
+
+	recorded := map[string]uint64{}
+	for path, count := range middleware.Snapshot().RequestsByPath {
+		recorded[path] = count
+	}
+	want := map[string]uint64{"/users/{id}": 1, "/orders": 1}
+	if len(recorded) != len(want) || recorded["/users/{id}"] != 1 || recorded["/orders"] != 1 {
+		t.Errorf("recorded %v, want %v", recorded, want)
+	}
+}
@@ -0,0 +1,84 @@
+package prometheusmiddleware
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inflightShards is the number of shards of the in-flight requests, spreading the lock
+// contention of concurrent requests.
+const inflightShards = 16
+
+// inflightRequests tracks the start times of the requests being served, to expose the age of
+// the oldest one when scraped. Requests are spread across shards by their id.
+type inflightRequests struct {
+	gauge prometheus.GaugeFunc
+	now   func() time.Time
+
+	nextID uint64
+	shards [inflightShards]inflightShard
+}
+
+type inflightShard struct {
+	mu     sync.Mutex
+	starts map[uint64]time.Time
+}
+
+func newInflightRequests(opts Opts) *inflightRequests {
+	in := &inflightRequests{now: opts.Now}
+	for i := range in.shards {
+		in.shards[i].starts = make(map[uint64]time.Time)
+	}
+	in.gauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Name:        oldestInflightName,
+			Help:        "How long the oldest HTTP request being served has been running, 0 when none is.",
+			Subsystem:   opts.Subsystem,
+			ConstLabels: opts.ConstLabels,
+		},
+		in.oldest,
+	)
+	return in
+}
+
+// add tracks a request started at begin, returning the id to remove it with.
+func (in *inflightRequests) add(begin time.Time) uint64 {
+	id := atomic.AddUint64(&in.nextID, 1)
+	shard := &in.shards[id%inflightShards]
+	shard.mu.Lock()
+	shard.starts[id] = begin
+	shard.mu.Unlock()
+	return id
+}
+
+// remove stops tracking the request of the id.
+func (in *inflightRequests) remove(id uint64) {
+	shard := &in.shards[id%inflightShards]
+	shard.mu.Lock()
+	delete(shard.starts, id)
+	shard.mu.Unlock()
+}
+
+// oldest returns the age in seconds of the oldest request being served, or 0 when none is.
+func (in *inflightRequests) oldest() float64 {
+	var oldest time.Time
+	for i := range in.shards {
+		shard := &in.shards[i]
+		shard.mu.Lock()
+		for _, begin := range shard.starts {
+			if oldest.IsZero() || begin.Before(oldest) {
+				oldest = begin
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	if oldest.IsZero() {
+		return 0
+	}
+	return seconds(in.now().Sub(oldest))
+}
@@ -0,0 +1,147 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_inflightRequests(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	in := newInflightRequests(Opts{Now: func() time.Time { return begin.Add(10 * time.Second) }})
+
+	if got := in.oldest(); got != 0 {
+		t.Errorf("oldest() without requests = %v, want 0", got)
+	}
+
+	first := in.add(begin.Add(2 * time.Second))
+	second := in.add(begin.Add(7 * time.Second))
+	if got := in.oldest(); got != 8 {
+		t.Errorf("oldest() = %v, want 8", got)
+	}
+
+	in.remove(first)
+	if got := in.oldest(); got != 3 {
+		t.Errorf("oldest() once the first request is done = %v, want 3", got)
+	}
+	in.remove(second)
+	if got := in.oldest(); got != 0 {
+		t.Errorf("oldest() once every request is done = %v, want 0", got)
+	}
+}
+
+func Test_InstrumentOldestInFlight(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:         []prometheus.Registerer{prometheus.NewRegistry()},
+		TrackOldestInFlight: true,
+	})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	r := mux.NewRouter()
+	r.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stuck", nil))
+	}()
+
+	<-started
+	time.Sleep(10 * time.Millisecond)
+	if got := readMetric(t, middleware.inflight.gauge).GetGauge().GetValue(); got < 0.01 {
+		t.Errorf("oldest in-flight request = %v, want at least 0.01", got)
+	}
+
+	close(release)
+	wg.Wait()
+	if got := readMetric(t, middleware.inflight.gauge).GetGauge().GetValue(); got != 0 {
+		t.Errorf("oldest in-flight request once served = %v, want 0", got)
+	}
+}
+
+func Test_InstrumentInFlightByPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		instrument func(middleware *PrometheusMiddleware, r *mux.Router) http.Handler
+	}{
+		{name: "use", instrument: func(middleware *PrometheusMiddleware, r *mux.Router) http.Handler {
+			r.Use(middleware.InstrumentHandlerDuration)
+			return r
+		}},
+		{name: "router", instrument: func(middleware *PrometheusMiddleware, r *mux.Router) http.Handler {
+			return middleware.InstrumentRouter(r)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			middleware := NewPrometheusMiddleware(Opts{
+				Registerers:         []prometheus.Registerer{prometheus.NewRegistry()},
+				TrackInFlightByPath: true,
+				// The routes are far from the cap, so their first requests keep their path.
+				MaxDistinctPaths: 10,
+			})
+
+			started, release := make(chan struct{}), make(chan struct{})
+			r := mux.NewRouter()
+			r.HandleFunc("/stuck/{id}", func(w http.ResponseWriter, r *http.Request) {
+				started <- struct{}{}
+				<-release
+			})
+			r.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+				panic("failure")
+			})
+			handler := tt.instrument(middleware, r)
+
+			var wg sync.WaitGroup
+			for _, target := range []string{"/stuck/1", "/stuck/2"} {
+				wg.Add(1)
+				go func(target string) {
+					defer wg.Done()
+					handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+				}(target)
+				<-started
+			}
+
+			stuck := middleware.concurrent.WithLabelValues("/stuck/{id}", "get")
+			if got := readMetric(t, stuck).GetGauge().GetValue(); got != 2 {
+				t.Errorf("in-flight requests of /stuck/{id} = %v, want 2", got)
+			}
+
+			close(release)
+			wg.Wait()
+			if got := readMetric(t, stuck).GetGauge().GetValue(); got != 0 {
+				t.Errorf("in-flight requests of /stuck/{id} once served = %v, want 0", got)
+			}
+
+			func() {
+				defer func() { recover() }()
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+			}()
+			if got := readMetric(t, middleware.concurrent.WithLabelValues("/panic", "get")).GetGauge().GetValue(); got != 0 {
+				t.Errorf("in-flight requests of /panic once panicked = %v, want 0", got)
+			}
+		})
+	}
+}
+
+func BenchmarkInflightRequests(b *testing.B) {
+	in := newInflightRequests(Opts{Now: time.Now})
+	begin := time.Now()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			in.remove(in.add(begin))
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultLabels are the labels of every metric partitioned by request.
+var defaultLabels = []string{"code", "method", "path"}
+
+// initLabels sets the label names of the collectors which have optional labels.
+// Values are looked up by name, so the order does not matter.
+func (p *PrometheusMiddleware) initLabels() {
+	p.requestLabels = append([]string{}, defaultLabels...)
+	p.latencyLabels = append([]string{}, defaultLabels...)
+	p.resSizeLabels = append([]string{}, defaultLabels...)
+
+	if p.opts.HandlerNameFunc != nil {
+		p.requestLabels = append(p.requestLabels, "handler")
+		p.latencyLabels = append(p.latencyLabels, "handler")
+	}
+	if p.opts.OperationLabelFunc != nil {
+		p.requestLabels = append(p.requestLabels, "operation")
+		p.latencyLabels = append(p.latencyLabels, "operation")
+	}
+	if p.opts.RouteIdentityFunc != nil {
+		p.requestLabels = append(p.requestLabels, "route")
+		p.latencyLabels = append(p.latencyLabels, "route")
+	}
+	for _, query := range p.queries {
+		p.requestLabels = append(p.requestLabels, query.name)
+		p.latencyLabels = append(p.latencyLabels, query.name)
+	}
+	if p.opts.LabelConditionalRequests {
+		p.requestLabels = append(p.requestLabels, "conditional")
+	}
+	if p.opts.LabelAllowedMethods {
+		p.requestLabels = append(p.requestLabels, "allowed_methods")
+	}
+	if p.opts.CacheStatusHeader != "" {
+		p.requestLabels = append(p.requestLabels, "cache")
+	}
+	if p.opts.CircuitHeader != "" {
+		p.requestLabels = append(p.requestLabels, "circuit")
+		p.latencyLabels = append(p.latencyLabels, "circuit")
+	}
+	if p.opts.FeatureFlagHeader != "" {
+		p.requestLabels = append(p.requestLabels, "feature")
+		p.latencyLabels = append(p.latencyLabels, "feature")
+	}
+	if p.opts.TrackAcceptHeader {
+		p.requestLabels = append(p.requestLabels, "accept")
+	}
+	if p.opts.LabelProtocol {
+		p.requestLabels = append(p.requestLabels, "proto")
+		p.latencyLabels = append(p.latencyLabels, "proto")
+	}
+	if p.regions != nil {
+		p.requestLabels = append(p.requestLabels, "region")
+	}
+	if p.opts.LabelWarmup {
+		p.requestLabels = append(p.requestLabels, "warmup")
+		p.latencyLabels = append(p.latencyLabels, "warmup")
+	}
+	if p.opts.LabelSlowRequests {
+		p.latencyLabels = append(p.latencyLabels, "slow")
+	}
+	if p.opts.LabelCompressed {
+		p.latencyLabels = append(p.latencyLabels, "compressed")
+	}
+	if p.opts.LabelResponseEncoding {
+		p.resSizeLabels = append(p.resSizeLabels, "encoding")
+	}
+}
+
+// labels returns the value of every enabled label of a served request.
+func (p *PrometheusMiddleware) labels(r *http.Request, delegate *responseWriterDelegator, path string, elapsed time.Duration) prometheus.Labels {
+	labels := prometheus.Labels{
+		"code":   p.codeLabel(p.status(delegate)),
+		"method": sanitizeMethod(r.Method),
+		"path":   path,
+	}
+
+	if p.opts.StatusFromResponse != nil {
+		labels["code"] = p.opts.StatusFromResponse(delegate)
+	}
+	if p.opts.HandlerNameFunc != nil {
+		labels["handler"] = p.opts.HandlerNameFunc(r)
+	}
+	if p.opts.OperationLabelFunc != nil {
+		labels["operation"] = p.opts.OperationLabelFunc(r)
+	}
+	if p.opts.RouteIdentityFunc != nil {
+		labels["route"] = p.opts.RouteIdentityFunc(r)
+		if labels["route"] == "" {
+			labels["route"] = path
+		}
+	}
+	if len(p.queries) > 0 {
+		params := r.URL.Query()
+		for _, query := range p.queries {
+			labels[query.name] = query.value(params)
+		}
+	}
+	if p.opts.LabelConditionalRequests {
+		labels["conditional"] = strconv.FormatBool(isConditional(r))
+	}
+	if p.opts.LabelAllowedMethods {
+		labels["allowed_methods"] = allowedMethods(r)
+	}
+	if p.opts.CacheStatusHeader != "" {
+		labels["cache"] = cacheStatus(delegate.Header(), p.opts.CacheStatusHeader)
+	}
+	if p.opts.CircuitHeader != "" {
+		labels["circuit"] = circuitState(delegate.Header(), p.opts.CircuitHeader)
+	}
+	if p.opts.FeatureFlagHeader != "" {
+		labels["feature"] = featureFlag(r.Header, p.opts.FeatureFlagHeader)
+	}
+	if p.opts.TrackAcceptHeader {
+		labels["accept"] = acceptClass(r.Header.Get("Accept"))
+	}
+	if p.opts.LabelProtocol {
+		labels["proto"] = protocol(r)
+	}
+	if p.regions != nil {
+		labels["region"] = p.regions.region(r)
+	}
+	if p.opts.LabelSlowRequests {
+		labels["slow"] = strconv.FormatBool(elapsed > p.opts.SlowRequestThreshold)
+	}
+	if p.opts.LabelCompressed {
+		labels["compressed"] = strconv.FormatBool(contentEncoding(delegate.Header()) != "identity")
+	}
+	if p.opts.LabelResponseEncoding {
+		labels["encoding"] = contentEncoding(delegate.Header())
+	}
+	return labels
+}
+
+// protocol returns the bounded proto label of the request.
+func protocol(r *http.Request) string {
+	switch {
+	case r.ProtoMajor == 1 && r.ProtoMinor == 0:
+		return "http/1.0"
+	case r.ProtoMajor == 1 && r.ProtoMinor == 1:
+		return "http/1.1"
+	case r.ProtoMajor == 2:
+		return "http/2"
+	case r.ProtoMajor == 3:
+		return "http/3"
+	default:
+		return "other"
+	}
+}
+
+// allowedMethods returns the sorted, lowercased and comma separated methods declared
+// by the matched gorilla/mux route, or "any" when the route has no method constraint.
+func allowedMethods(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "any"
+	}
+
+	methods, err := route.GetMethods()
+	if err != nil || len(methods) == 0 {
+		return "any"
+	}
+
+	sorted := make([]string, len(methods))
+	for i, method := range methods {
+		sorted[i] = sanitizeMethod(method)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// labelValues returns the values of the given label names, in the same order.
+func labelValues(labels prometheus.Labels, names []string) []string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = labels[name]
+	}
+	return values
+}
+
+// labelSubset returns the labels with the given names, for the collectors provided through
+// Opts.RequestCounter and Opts.LatencyHistogram whose label order is not known.
+func labelSubset(labels prometheus.Labels, names []string) prometheus.Labels {
+	subset := make(prometheus.Labels, len(names))
+	for _, name := range names {
+		subset[name] = labels[name]
+	}
+	return subset
+}
+
+// cacheStatus returns the bounded cache label from the value of the cache status header.
+func cacheStatus(h http.Header, name string) string {
+	values := h.Values(name)
+	if len(values) == 0 {
+		return "none"
+	}
+
+	switch status := strings.ToUpper(strings.TrimSpace(values[0])); status {
+	case "HIT", "MISS":
+		return status
+	default:
+		return "other"
+	}
+}
+
+// cacheValidator returns the bounded cacheable label of a response from its headers.
+func cacheValidator(h http.Header) string {
+	if h.Get("ETag") != "" || h.Get("Last-Modified") != "" {
+		return "has-validator"
+	}
+	return "none"
+}
+
+// circuitState returns the bounded circuit label from the value of the circuit breaker header.
+func circuitState(h http.Header, name string) string {
+	values := h.Values(name)
+	if len(values) == 0 {
+		return "none"
+	}
+
+	switch state := strings.ToLower(strings.TrimSpace(values[0])); state {
+	case "open":
+		return state
+	case "half-open", "half_open":
+		return "half_open"
+	default:
+		return "other"
+	}
+}
+
+// featureFlag returns the bounded feature label from the value of the feature flag header.
+func featureFlag(h http.Header, name string) string {
+	switch strings.ToLower(strings.TrimSpace(h.Get(name))) {
+	case "1", "true", "on", "yes", "enabled":
+		return "on"
+	case "0", "false", "off", "no", "disabled":
+		return "off"
+	default:
+		return "absent"
+	}
+}
+
+// acceptClass returns the bounded accept label from the first media type of the Accept header.
+func acceptClass(accept string) string {
+	mediaType := accept
+	if i := strings.IndexByte(mediaType, ','); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+	if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+		mediaType = mediaType[:i]
+	}
+
+	switch mediaType = strings.ToLower(strings.TrimSpace(mediaType)); {
+	case mediaType == "" || mediaType == "*/*":
+		return "any"
+	case strings.Contains(mediaType, "html"):
+		return "html"
+	case strings.HasSuffix(mediaType, "/json") || strings.HasSuffix(mediaType, "+json"):
+		return "json"
+	case strings.HasSuffix(mediaType, "/xml") || strings.HasSuffix(mediaType, "+xml"):
+		return "xml"
+	default:
+		return "other"
+	}
+}
+
+// contentEncoding returns the bounded encoding label from the Content-Encoding of the response.
+func contentEncoding(h http.Header) string {
+	switch encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return "identity"
+	case "gzip", "br", "deflate", "zstd":
+		return encoding
+	default:
+		return "other"
+	}
+}
+
+// isPreflight reports whether the request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// isConditional reports whether the request is a conditional GET or HEAD validating a cached response.
+func isConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
@@ -0,0 +1,186 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func Test_cacheStatus(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: "none"},
+		{value: "HIT", want: "HIT"},
+		{value: "hit", want: "HIT"},
+		{value: " MISS ", want: "MISS"},
+		{value: "STALE", want: "other"},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.value != "" {
+			h.Set("X-Cache", tt.value)
+		}
+		if got := cacheStatus(h, "X-Cache"); got != tt.want {
+			t.Errorf("cacheStatus(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func Test_circuitState(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: "none"},
+		{value: "open", want: "open"},
+		{value: " OPEN ", want: "open"},
+		{value: "half-open", want: "half_open"},
+		{value: "half_open", want: "half_open"},
+		{value: "closed", want: "other"},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.value != "" {
+			h.Set("X-Circuit", tt.value)
+		}
+		if got := circuitState(h, "X-Circuit"); got != tt.want {
+			t.Errorf("circuitState(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func Test_featureFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: "absent"},
+		{value: "true", want: "on"},
+		{value: " ON ", want: "on"},
+		{value: "0", want: "off"},
+		{value: "disabled", want: "off"},
+		{value: "maybe", want: "absent"},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.value != "" {
+			h.Set("X-Feature-Flag", tt.value)
+		}
+		if got := featureFlag(h, "X-Feature-Flag"); got != tt.want {
+			t.Errorf("featureFlag(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func Test_acceptClass(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: "any"},
+		{accept: "*/*", want: "any"},
+		{accept: "application/json", want: "json"},
+		{accept: "application/problem+json; charset=utf-8", want: "json"},
+		{accept: "Application/XML", want: "xml"},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: "html"},
+		{accept: "image/png", want: "other"},
+	}
+
+	for _, tt := range tests {
+		if got := acceptClass(tt.accept); got != tt.want {
+			t.Errorf("acceptClass(%q) = %s, want %s", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func Test_contentEncoding(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: "identity"},
+		{value: "identity", want: "identity"},
+		{value: "gzip", want: "gzip"},
+		{value: "BR", want: "br"},
+		{value: "gzip, br", want: "other"},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		h.Set("Content-Encoding", tt.value)
+		if got := contentEncoding(h); got != tt.want {
+			t.Errorf("contentEncoding(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func Test_allowedMethods(t *testing.T) {
+	var got []string
+	capture := func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, allowedMethods(r))
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", capture).Methods("POST", "GET")
+	r.HandleFunc("/health", capture)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	got = append(got, allowedMethods(httptest.NewRequest("GET", "/", nil)))
+
+	want := []string{"get,post", "any", "any"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("allowedMethods() = %q, want %q", got[i], want[i])
+		}
+	}
+}
+
+func Test_protocol(t *testing.T) {
+	tests := []struct {
+		major, minor int
+		want         string
+	}{
+		{major: 1, minor: 0, want: "http/1.0"},
+		{major: 1, minor: 1, want: "http/1.1"},
+		{major: 2, minor: 0, want: "http/2"},
+		{major: 3, minor: 0, want: "http/3"},
+		{major: 0, minor: 9, want: "other"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.ProtoMajor, r.ProtoMinor = tt.major, tt.minor
+		if got := protocol(r); got != tt.want {
+			t.Errorf("protocol(%d.%d) = %s, want %s", tt.major, tt.minor, got, tt.want)
+		}
+	}
+}
+
+func Test_isConditional(t *testing.T) {
+	tests := []struct {
+		header, value string
+		want          bool
+	}{
+		{"", "", false},
+		{"If-None-Match", `"33a64df5"`, true},
+		{"If-Modified-Since", "Wed, 21 Oct 2015 07:28:00 GMT", true},
+		{"If-Match", `"33a64df5"`, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := isConditional(r); got != tt.want {
+			t.Errorf("isConditional() with %s = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package prometheusmiddleware
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// overflowPath is the path label of the paths seen once Opts.MaxDistinctPaths was reached.
+const overflowPath = "overflow"
+
+// pathLimiter caps the number of distinct path labels. The first paths seen are kept
+// and never evicted, the others collapse into overflowPath.
+type pathLimiter struct {
+	max   int64
+	count int64
+	seen  sync.Map
+}
+
+func newPathLimiter(max int) *pathLimiter {
+	return &pathLimiter{max: int64(max)}
+}
+
+// limit returns the path when it was already seen or there is room left for it, else overflowPath.
+func (l *pathLimiter) limit(path string) string {
+	if _, ok := l.seen.Load(path); ok {
+		return path
+	}
+
+	// Reserve a slot before storing the path, so that concurrent requests never exceed the cap.
+	if atomic.AddInt64(&l.count, 1) > l.max {
+		atomic.AddInt64(&l.count, -1)
+		return overflowPath
+	}
+	if _, loaded := l.seen.LoadOrStore(path, struct{}{}); loaded {
+		atomic.AddInt64(&l.count, -1)
+	}
+	return path
+}
@@ -0,0 +1,47 @@
+package prometheusmiddleware
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func Test_pathLimiter(t *testing.T) {
+	l := newPathLimiter(2)
+
+	for _, tt := range []struct{ path, want string }{
+		{"/a", "/a"},
+		{"/b", "/b"},
+		{"/c", "overflow"},
+		{"/a", "/a"},
+		{"/d", "overflow"},
+	} {
+		if got := l.limit(tt.path); got != tt.want {
+			t.Errorf("limit(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func Test_pathLimiterConcurrent(t *testing.T) {
+	l := newPathLimiter(10)
+
+	var mu sync.Mutex
+	kept := make(map[string]struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if path := l.limit(fmt.Sprintf("/%d", i%50)); path != overflowPath {
+				mu.Lock()
+				kept[path] = struct{}{}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(kept) != 10 {
+		t.Errorf("kept %d distinct paths, want 10", len(kept))
+	}
+}
@@ -0,0 +1,136 @@
+package prometheusmiddleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// slowLogBufferSize is how many slow request lines can wait for the logging goroutine before
+// the next ones are dropped.
+const slowLogBufferSize = 256
+
+// Logger logs the warnings of the middleware, like collectors which failed to register.
+// *log.Logger implements it.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+// stdLogger logs through the standard logger of the log package.
+type stdLogger struct{}
+
+func (stdLogger) Println(v ...interface{}) {
+	log.Println(v...)
+}
+
+// logger returns the configured Logger, defaulting to the standard logger.
+func (opts Opts) logger() Logger {
+	if opts.Logger == nil {
+		return stdLogger{}
+	}
+	return opts.Logger
+}
+
+// slowLogger logs the lines of Opts.SlowRequestLogger on a single background goroutine, so
+// that neither a slow Logger nor a burst of slow requests piles up goroutines.
+type slowLogger struct {
+	lines  chan string
+	logger Logger
+	self   *selfMetrics
+
+	// mu is read-locked by the senders and locked once to stop, like asyncRecorder.mu.
+	mu        sync.RWMutex
+	stopped   bool
+	closeOnce sync.Once
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+func newSlowLogger(logger Logger, size int) *slowLogger {
+	return &slowLogger{
+		lines:  make(chan string, size),
+		logger: logger,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// run logs the lines until the logger is stopped, then logs those left in the buffer.
+func (l *slowLogger) run() {
+	defer close(l.done)
+
+	for {
+		select {
+		case line := <-l.lines:
+			l.logger.Println(line)
+		case <-l.quit:
+			for {
+				select {
+				case line := <-l.lines:
+					l.logger.Println(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// log hands the line to the logging goroutine, dropping it when the buffer is full. Once the
+// logger is stopped, the line is logged by the caller.
+func (l *slowLogger) log(line string) {
+	l.mu.RLock()
+	if l.stopped {
+		l.mu.RUnlock()
+		l.logger.Println(line)
+		return
+	}
+	defer l.mu.RUnlock()
+
+	select {
+	case l.lines <- line:
+	default:
+		l.self.dropLog()
+	}
+}
+
+// stop stops the logging goroutine once it has logged the buffered lines, or fails when the
+// context is done first.
+func (l *slowLogger) stop(ctx context.Context) error {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		l.stopped = true
+		close(l.quit)
+		l.mu.Unlock()
+	})
+
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// slowRequestLine returns the line logged by Opts.SlowRequestLogger, in a logfmt-like format
+// with the labels of Opts.ExemplarLabels sorted by name.
+func (p *PrometheusMiddleware) slowRequestLine(r *http.Request, o *observation) string {
+	line := fmt.Sprintf("slow request: method=%s path=%q code=%s duration=%s",
+		o.labels["method"], o.path, o.labels["code"], o.elapsed)
+
+	if p.opts.ExemplarLabels != nil {
+		labels := p.opts.ExemplarLabels(r.Context())
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			line += fmt.Sprintf(" %s=%q", name, labels[name])
+		}
+	}
+	return line
+}
@@ -0,0 +1,139 @@
+package prometheusmiddleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_Logger(t *testing.T) {
+	var buf bytes.Buffer
+	registry := prometheus.NewRegistry()
+	opts := Opts{Registerers: []prometheus.Registerer{registry}, Logger: log.New(&buf, "", 0)}
+
+	NewPrometheusMiddleware(opts)
+	if buf.Len() != 0 {
+		t.Fatalf("first registration logged %q", buf.String())
+	}
+
+	NewPrometheusMiddleware(opts)
+	if !strings.HasPrefix(buf.String(), "prometheusMiddleware.request was not registered:") {
+		t.Errorf("second registration logged %q, want the registration failure", buf.String())
+	}
+}
+
+type chanLogger chan string
+
+func (l chanLogger) Println(v ...interface{}) {
+	l <- fmt.Sprint(v...)
+}
+
+func Test_SlowRequestLogger(t *testing.T) {
+	lines := make(chanLogger, 2)
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := []time.Time{
+		begin, begin.Add(100 * time.Millisecond),
+		begin, begin.Add(1500 * time.Millisecond),
+	}
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:          []prometheus.Registerer{prometheus.NewRegistry()},
+		Now:                  fakeClock(clock...),
+		SlowRequestThreshold: time.Second,
+		SlowRequestLogger:    lines,
+		ExemplarLabels: func(ctx context.Context) prometheus.Labels {
+			return prometheus.Labels{"trace_id": "4bf92f3577b34da6"}
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2", nil))
+
+	want := `slow request: method=get path="/users/{id}" code=202 duration=1.5s trace_id="4bf92f3577b34da6"`
+	select {
+	case line := <-lines:
+		if line != want {
+			t.Errorf("logged %q, want %q", line, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow request was not logged")
+	}
+	select {
+	case line := <-lines:
+		t.Errorf("fast request logged %q", line)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func Test_slowLoggerDropsWhenFull(t *testing.T) {
+	lines := make(chanLogger, 2)
+	self := newSelfMetrics(Opts{})
+	logger := newSlowLogger(lines, 1)
+	logger.self = self
+
+	// Nothing logs the lines yet, so the second one finds the buffer full.
+	logger.log("first")
+	logger.log("second")
+	if got := atomic.LoadInt64(&self.droppedLogs); got != 1 {
+		t.Errorf("dropped lines = %d, want 1", got)
+	}
+
+	go logger.run()
+	if err := logger.stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if line := <-lines; line != "first" {
+		t.Errorf("logged %q, want first", line)
+	}
+
+	logger.log("after shutdown")
+	if line := <-lines; line != "after shutdown" {
+		t.Errorf("logged %q after shutdown, want it logged in place", line)
+	}
+}
+
+func Test_UnroutedWarning(t *testing.T) {
+	var buf bytes.Buffer
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Logger:      log.New(&buf, "", 0),
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("request served by a route logged %q", buf.String())
+	}
+
+	handler := middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2", nil))
+
+	if lines := strings.Count(buf.String(), "\n"); lines != 1 {
+		t.Errorf("requests outside of a router logged %d lines, want 1: %q", lines, buf.String())
+	}
+	if !strings.Contains(buf.String(), "PathLabelFunc") {
+		t.Errorf("logged %q, want a hint at PathLabelFunc", buf.String())
+	}
+	if got := middleware.Snapshot().RequestsByPath["/users/:id"]; got != 2 {
+		t.Errorf("requests outside of a router recorded %d times, want 2", got)
+	}
+}
@@ -0,0 +1,38 @@
+// Package prometheusotel bridges prometheusmiddleware and OpenTelemetry tracing.
+// It lives in its own module so that users of the middleware are not forced to
+// depend on OpenTelemetry.
+package prometheusotel
+
+import (
+	"context"
+	"net/http"
+
+	prometheusmiddleware "github.com/spl0i7/prometheus-middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AnnotateSpan sets the HTTP semantic-convention attributes of the request on the
+// span active in its context. It is meant to be used as prometheusmiddleware.Opts.Annotate.
+func AnnotateSpan(r *http.Request, info prometheusmiddleware.RequestInfo) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+
+	attributes := []attribute.KeyValue{
+		attribute.Int("http.status_code", info.Code),
+		attribute.String("http.route", info.Path),
+		attribute.Int64("http.response_content_length", info.ResponseSize),
+	}
+	if r.ContentLength >= 0 {
+		attributes = append(attributes, attribute.Int64("http.request_content_length", r.ContentLength))
+	}
+	span.SetAttributes(attributes...)
+}
+
+// IsSampled reports whether the span context of ctx is sampled. It is meant to be used
+// as prometheusmiddleware.Opts.IsSampled.
+func IsSampled(ctx context.Context) bool {
+	return trace.SpanContextFromContext(ctx).IsSampled()
+}
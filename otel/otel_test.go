@@ -0,0 +1,68 @@
+package prometheusotel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	prometheusmiddleware "github.com/spl0i7/prometheus-middleware"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func Test_AnnotateSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	middleware := prometheusmiddleware.NewPrometheusMiddleware(prometheusmiddleware.Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Annotate:    AnnotateSpan,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	req := httptest.NewRequest("GET", "/users/42", nil)
+	ctx, span := tracer.Start(req.Context(), "request")
+	r.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	span.End()
+
+	attributes := make(map[string]string)
+	for _, attribute := range recorder.Ended()[0].Attributes() {
+		attributes[string(attribute.Key)] = attribute.Value.Emit()
+	}
+
+	want := map[string]string{
+		"http.status_code":             "418",
+		"http.route":                   "/users/{id}",
+		"http.response_content_length": "0",
+		"http.request_content_length":  "0",
+	}
+	for key, value := range want {
+		if attributes[key] != value {
+			t.Errorf("span attribute %s = %q, want %q", key, attributes[key], value)
+		}
+	}
+}
+
+func Test_IsSampled(t *testing.T) {
+	for sampler, want := range map[sdktrace.Sampler]bool{sdktrace.AlwaysSample(): true, sdktrace.NeverSample(): false} {
+		tracer := sdktrace.NewTracerProvider(sdktrace.WithSampler(sampler)).Tracer("test")
+		ctx, span := tracer.Start(context.Background(), "request")
+
+		if got := IsSampled(ctx); got != want {
+			t.Errorf("IsSampled() with %s = %v, want %v", sampler.Description(), got, want)
+		}
+		span.End()
+	}
+
+	if IsSampled(context.Background()) {
+		t.Error("IsSampled() without span = true, want false")
+	}
+}
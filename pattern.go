@@ -0,0 +1,20 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// StdlibPatternPath returns the path of the net/http.ServeMux pattern which matched the request,
+// without its method and host, e.g. "/users/{id}" for "GET example.com/users/{id}". It returns ""
+// when no pattern matched, and always before Go 1.23 which added http.Request.Pattern.
+func StdlibPatternPath(r *http.Request) string {
+	pattern := requestPattern(r)
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		pattern = strings.TrimLeft(pattern[i+1:], " \t")
+	}
+	if i := strings.IndexByte(pattern, '/'); i > 0 {
+		pattern = pattern[i:]
+	}
+	return pattern
+}
@@ -0,0 +1,11 @@
+//go:build go1.23
+// +build go1.23
+
+package prometheusmiddleware
+
+import "net/http"
+
+// requestPattern returns the net/http.ServeMux pattern which matched the request.
+func requestPattern(r *http.Request) string {
+	return r.Pattern
+}
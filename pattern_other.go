@@ -0,0 +1,11 @@
+//go:build !go1.23
+// +build !go1.23
+
+package prometheusmiddleware
+
+import "net/http"
+
+// requestPattern returns "" as http.Request has no Pattern before Go 1.23.
+func requestPattern(r *http.Request) string {
+	return ""
+}
@@ -0,0 +1,123 @@
+//go:build go1.23
+// +build go1.23
+
+// The go.mod of the module predates Go 1.22, which would otherwise keep the legacy ServeMux.
+//go:debug httpmuxgo121=0
+
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_StdlibPatternPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{"", ""},
+		{"/users/{id}", "/users/{id}"},
+		{"GET /users/{id}", "/users/{id}"},
+		{"example.com/users/", "/users/"},
+		{"POST example.com/users/{id...}", "/users/{id...}"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Pattern = tt.pattern
+		if got := StdlibPatternPath(r); got != tt.want {
+			t.Errorf("StdlibPatternPath() of %q = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func Test_InstrumentServeMux(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{name}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle("GET /orders/{id}", middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	wrapped := middleware.InstrumentHandlerDuration(mux)
+	wrapped.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/alice", nil))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/42", nil))
+
+	for _, path := range []string{"/users/{name}", "/orders/{id}"} {
+		if got := readMetric(t, middleware.request.WithLabelValues("200", "get", path)).GetCounter().GetValue(); got != 1 {
+			t.Errorf("requests of %s = %v, want 1", path, got)
+		}
+	}
+}
+
+func Test_InstrumentServeMuxRouteAllowList(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:    []prometheus.Registerer{prometheus.NewRegistry()},
+		RouteAllowList: []string{"/users/{name}"},
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{name}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /orders/{id}", func(w http.ResponseWriter, r *http.Request) {})
+
+	wrapped := middleware.InstrumentHandlerDuration(mux)
+	wrapped.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/alice", nil))
+	wrapped.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/42", nil))
+	wrapped.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	if got, want := middleware.Snapshot().RequestsByPath, map[string]uint64{"/users/{name}": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("requests by path = %v, want %v", got, want)
+	}
+}
+
+func Test_InstrumentServeMuxInFlightKeepsDistinctPaths(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:         []prometheus.Registerer{prometheus.NewRegistry()},
+		TrackInFlightByPath: true,
+		MaxDistinctPaths:    1,
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{name}", func(w http.ResponseWriter, r *http.Request) {})
+
+	// The in-flight path is pending until the mux matched, which must not take the only slot.
+	wrapped := middleware.InstrumentHandlerDuration(mux)
+	wrapped.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/alice", nil))
+
+	if got, want := middleware.Snapshot().RequestsByPath, map[string]uint64{"/users/{name}": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("requests by path = %v, want %v", got, want)
+	}
+}
+
+func Test_InstrumentServeMuxInFlightBounded(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:         []prometheus.Registerer{registry},
+		TrackInFlightByPath: true,
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{name}", func(w http.ResponseWriter, r *http.Request) {})
+
+	wrapped := middleware.InstrumentHandlerDuration(mux)
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		wrapped.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/"+name, nil))
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == inflightName {
+			if series := len(family.GetMetric()); series != 1 {
+				t.Errorf("in-flight series of 4 users = %d, want 1", series)
+			}
+			return
+		}
+	}
+	t.Error("in-flight gauge was not gathered")
+}
@@ -0,0 +1,62 @@
+package prometheusmiddleware
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type phaseTimerKey struct{}
+
+// PhaseTimer records how long the phases of a request, like "auth", "db" or "render",
+// took. The middleware puts one in the context of every request when Opts.Phases is
+// set and observes the recorded durations once the handler returns. Its methods are
+// safe to call on a nil PhaseTimer, which records nothing.
+type PhaseTimer struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	durations map[string]time.Duration
+}
+
+// PhaseTimerFromContext returns the PhaseTimer of the request context, or nil.
+func PhaseTimerFromContext(ctx context.Context) *PhaseTimer {
+	t, _ := ctx.Value(phaseTimerKey{}).(*PhaseTimer)
+	return t
+}
+
+// Start starts timing the phase and returns the function stopping it.
+func (t *PhaseTimer) Start(phase string) func() {
+	if t == nil {
+		return func() {}
+	}
+
+	begin := t.now()
+	return func() {
+		t.Observe(phase, t.now().Sub(begin))
+	}
+}
+
+// Observe adds d to the duration of the phase.
+func (t *PhaseTimer) Observe(phase string, d time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.durations[phase] += d
+	t.mu.Unlock()
+}
+
+// snapshot returns a copy of the recorded durations, which handlers may still update
+// from goroutines outliving the request.
+func (t *PhaseTimer) snapshot() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	durations := make(map[string]time.Duration, len(t.durations))
+	for phase, d := range t.durations {
+		durations[phase] = d
+	}
+	return durations
+}
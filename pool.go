@@ -0,0 +1,35 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"sync"
+)
+
+var delegatorPool = sync.Pool{
+	New: func() interface{} {
+		return new(responseWriterDelegator)
+	},
+}
+
+// newDelegator returns a responseWriterDelegator wrapping w, taken from the pool
+// when Opts.PoolResponseWriters is set.
+func (p *PrometheusMiddleware) newDelegator(w http.ResponseWriter) *responseWriterDelegator {
+	if !p.opts.PoolResponseWriters {
+		return &responseWriterDelegator{ResponseWriter: w}
+	}
+
+	delegate := delegatorPool.Get().(*responseWriterDelegator)
+	*delegate = responseWriterDelegator{ResponseWriter: w}
+	return delegate
+}
+
+// releaseDelegator returns the delegator to the pool once the request has been recorded.
+// A hijacked delegator is never returned as the connection may still reference it.
+func (p *PrometheusMiddleware) releaseDelegator(delegate *responseWriterDelegator) {
+	if !p.opts.PoolResponseWriters || delegate.hijacked {
+		return
+	}
+
+	*delegate = responseWriterDelegator{}
+	delegatorPool.Put(delegate)
+}
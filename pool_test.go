@@ -0,0 +1,54 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func benchmarkInstrumentHandlerDuration(b *testing.B, opts Opts) {
+	opts.Registerers = []prometheus.Registerer{prometheus.NewRegistry()}
+	middleware := NewPrometheusMiddleware(opts)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ServeHTTP(w, req)
+	}
+}
+
+func BenchmarkInstrumentHandlerDuration(b *testing.B) {
+	benchmarkInstrumentHandlerDuration(b, Opts{})
+}
+
+func BenchmarkInstrumentHandlerDurationPooled(b *testing.B) {
+	benchmarkInstrumentHandlerDuration(b, Opts{PoolResponseWriters: true})
+}
+
+func Test_releaseDelegatorKeepsHijacked(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:         []prometheus.Registerer{prometheus.NewRegistry()},
+		PoolResponseWriters: true,
+	})
+
+	w := httptest.NewRecorder()
+	delegate := middleware.newDelegator(w)
+	delegate.hijacked = true
+	middleware.releaseDelegator(delegate)
+
+	if delegate.ResponseWriter != w {
+		t.Error("hijacked delegator was reset and returned to the pool")
+	}
+}
@@ -1,10 +1,18 @@
 package prometheusmiddleware
 
 import (
-	"log"
+	"bufio"
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,48 +20,664 @@ import (
 )
 
 var (
-	dflBuckets = []float64{0.05, 0.1, 0.3, 0.5, 1.0, 2.5, 5.0}
+	dflBuckets        = []float64{0.05, 0.1, 0.3, 0.5, 1.0, 2.5, 5.0}
+	dflSizeBuckets    = []float64{100, 1000, 5000, 20000, 50000}
+	dflRatioBuckets   = []float64{1, 10, 100, 1000}
+	dflHeaderBuckets  = []float64{100, 500, 1000, 2000, 4000, 8000, 16000}
+	dflDelayBuckets   = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+	dflSizeObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+
+	dflLatencyObjectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
 )
 
 const (
-	requestName      = "http_requests_total"
-	latencyName      = "http_request_duration_seconds"
-	responseSizeName = "response_size_bytes"
-	requestSizeName  = "request_size_bytes"
+	requestName        = "http_requests_total"
+	latencyName        = "http_request_duration_seconds"
+	responseSizeName   = "response_size_bytes"
+	requestSizeName    = "request_size_bytes"
+	ttfbName           = "http_time_to_first_byte_seconds"
+	bodyReadName       = "http_request_body_read_seconds"
+	headersTimeName    = "http_time_to_headers_seconds"
+	deadlineSlackName  = "http_request_deadline_slack_seconds"
+	fineLatencyName    = "http_request_fine_duration_seconds"
+	outcomeName        = "http_request_outcome_duration_seconds"
+	latencyMillisName  = "http_request_duration_milliseconds"
+	latencySummaryName = "http_request_duration_summary_seconds"
+	slowestName        = "http_slowest_request_seconds"
+	phaseName          = "http_request_phase_duration_seconds"
+	droppedName        = "http_async_dropped_observations_total"
+	sizeRatioName      = "http_response_request_size_ratio"
+	tlsVersionName     = "http_requests_by_tls_version_total"
+	tlsResumedName     = "http_tls_resumed_total"
+	tlsFullName        = "http_tls_full_handshake_total"
+	rejectedName       = "http_concurrency_rejected_total"
+	missingName        = "http_requests_missing_header_total"
+	validatorName      = "http_responses_by_validator_total"
+
+	requestHeaderSizeName  = "http_request_header_bytes"
+	headerBytesName        = "http_header_bytes"
+	rateLimitName          = "http_ratelimit_remaining"
+	truncatedName          = "http_request_truncated_total"
+	panicsName             = "http_panics_recovered_total"
+	distinctClientsName    = "http_distinct_clients_estimate"
+	oldestInflightName     = "http_oldest_inflight_request_seconds"
+	inflightName           = "http_requests_in_flight"
+	clampedName            = "http_request_latency_clamped_total"
+	latencyQuantileName    = "http_request_latency_quantile"
+	decompressedSizeName   = "http_request_decompressed_size_bytes"
+	schedulingDelayName    = "http_scheduling_delay_seconds"
+	requestBytesName       = "http_request_bytes_total"
+	responseBytesName      = "http_response_bytes_total"
+	rateName               = "http_requests_per_second"
+	responseHeaderSizeName = "http_response_header_bytes"
 )
 
+// redactedPath is the path label of the paths missing from Opts.PathAllowList.
+const redactedPath = "redacted"
+
+// preflightPath is the path label of the CORS preflight requests with Opts.CollapsePreflight.
+const preflightPath = "preflight"
+
+// pendingPath is the in-flight path label of the requests whose path is only known once the
+// handler returns, like those of a wrapped net/http.ServeMux.
+const pendingPath = "pending"
+
 // Opts specifies options how to create new PrometheusMiddleware.
 type Opts struct {
 	// Buckets specifies an custom buckets to be used in request histograpm.
 	Buckets []float64
+	// Namespace is the prefix of every metric name, before the Subsystem.
+	Namespace string
 	// Subsystem systems have sub-parts that should also be monitored.
 	Subsystem string
+	// ConstLabels are added to every metric, e.g. to identify the service.
+	ConstLabels prometheus.Labels
+	// AddHostnameLabel adds an "instance" constant label holding the hostname of the machine,
+	// for setups where the series of several instances are not told apart by the scrape, like
+	// pushes or federation. A scraped "instance" target label conflicts with it, see
+	// honor_labels. An "instance" label already in ConstLabels is kept.
+	AddHostnameLabel bool
+	// DeploymentLabel, e.g. "blue" or "green", is added as a "deployment" constant label to every
+	// metric, to compare the versions side by side during a rollout. A "deployment" label already in
+	// ConstLabels is kept. No label is added when empty.
+	DeploymentLabel string
+	// SizeAsSummary records request and response sizes in summaries instead of histograms.
+	SizeAsSummary bool
+	// SizeObjectives specifies the quantile objectives of the size summaries.
+	SizeObjectives map[float64]float64
+	// RequestSizeObserver configures the request size collector, replacing SizeAsSummary
+	// and SizeObjectives for it when set.
+	RequestSizeObserver *SizeObserver
+	// ResponseSizeObserver configures the response size collector, replacing SizeAsSummary
+	// and SizeObjectives for it when set.
+	ResponseSizeObserver *SizeObserver
+	// AccurateMultipartSize counts the bytes read from multipart request bodies, so that
+	// the request size includes the body of multipart uploads sent without a Content-Length.
+	// The body is only counted when the handler reads it, e.g. with ParseMultipartForm.
+	AccurateMultipartSize bool
+	// AccurateRequestLine adds to the request size what the approximation leaves out of the
+	// request line: the query string with its "?", and the two spaces and the CRLF separating
+	// the method, the request URI and the protocol. By default, the request size counts the
+	// URL path, method, protocol, host, header names and values, and Content-Length.
+	AccurateRequestLine bool
+	// RequestSizeComponents selects the parts of the requests which their size counts, e.g.
+	// RequestSizeBody alone to only count the bodies. Defaults to DefaultRequestSizeComponents.
+	RequestSizeComponents RequestSizeComponents
+	// SizeMetricsOnErrorsOnly only observes the request and response sizes, and their ratio, of the
+	// requests failing with a status code of 400 or more, cutting the series of the size histograms
+	// down to those of the failures. The size metrics then describe the failed requests only.
+	SizeMetricsOnErrorsOnly bool
+	// CheapRequestSize observes the Content-Length of the requests as their size, or 0 when it
+	// is unknown, rather than iterating over their headers. It overrides RequestSizeComponents,
+	// AccurateRequestLine and AccurateMultipartSize, for services where the cost matters more
+	// than counting the request line and headers.
+	CheapRequestSize bool
+	// TrackDecompressedRequestSize adds the http_request_decompressed_size_bytes histogram, observing
+	// the size of the request bodies once decompressed, as the handlers report it through the
+	// DecompressedSize of the request context. It is configured like the request size collector.
+	TrackDecompressedRequestSize bool
+	// CountBytes adds the http_request_bytes_total and http_response_bytes_total counters,
+	// partitioned by path, summing the request and response sizes as measured for the size
+	// histograms, for bandwidth accounting. Streaming responses are counted too. The counters are
+	// float64: their totals stay exact up to 2^53 bytes, about 9 PB, and round beyond.
+	CountBytes bool
+	// CodeLabelFunc maps the status code of the response to the code label, e.g. 429 to
+	// "rate_limited". It must return values from a small fixed set to keep the number
+	// of series bounded. Defaults to the numeric status code.
+	CodeLabelFunc func(status int) string
+	// DetailedCodes are the status codes keeping their own code label when set, e.g. the errors
+	// worth telling apart. The other codes are recorded with the "ok" code label, whatever their
+	// class, cutting the series of the successful requests. CodeLabelFunc only maps detailed codes.
+	DetailedCodes []int
+	// CountTruncatedResponses adds the http_request_truncated_total counter of the responses whose
+	// body failed to be written after the status, typically because the WriteTimeout of the server
+	// fired or the client went away, which are otherwise recorded with their successful status.
+	CountTruncatedResponses bool
+	// RecoverPanics recovers the panics of the handler, which would otherwise leave the request
+	// unrecorded, counting them in the http_panics_recovered_total counter partitioned by path.
+	// The panic is logged through Logger with its stack trace, and the request is recorded with
+	// a 500 status code, even when the handler already sent another one. The 500 is also written
+	// when the handler wrote nothing yet.
+	RecoverPanics bool
+	// DisablePanicStack only logs the value of the recovered panics, without their stack trace.
+	DisablePanicStack bool
+	// TruncatedStatus, when set, replaces the status code of the truncated responses in the metrics,
+	// e.g. http.StatusGatewayTimeout.
+	TruncatedStatus int
+	// WrapResponseWriter wraps the ResponseWriter given to the handler instead of the built-in
+	// wrapper, for applications which already wrap it to track the status and size, or which rely on
+	// interfaces it does not implement. The measures relying on the built-in wrapper, like the time to
+	// first byte and the response tail, are then unavailable.
+	WrapResponseWriter func(http.ResponseWriter) ResponseRecorder
+	// StatusFromResponse returns the code label of the response, overriding CodeLabelFunc, for
+	// protocols which send their status elsewhere than in the status code, like gRPC-Web
+	// in the trailer frame of the body.
+	StatusFromResponse func(CapturedResponse) string
+	// ResponseTailSize is how many trailing bytes of the response body are kept for StatusFromResponse.
+	ResponseTailSize int
+	// LabelCompressed adds a "compressed" label to the request duration histogram, which is "true"
+	// for responses with a Content-Encoding other than identity, to tell the latency cost of compression.
+	LabelCompressed bool
+	// LabelResponseEncoding adds an "encoding" label to the response size histogram from
+	// the Content-Encoding of the response: gzip, br, deflate, zstd, identity or other.
+	LabelResponseEncoding bool
+	// PathPrefixStrip is removed from the beginning of the route path template
+	// before it is used as the path label. Useful for subrouters mounted with PathPrefix.
+	PathPrefixStrip string
+	// MetricsPath is the path of the metrics endpoint, whose scrapes are not instrumented.
+	// Setup mounts the endpoint there, defaulting it to "/metrics".
+	MetricsPath string
+	// IgnorePaths are the paths, route templates or URL paths, which are not instrumented.
+	IgnorePaths []string
+	// IgnorePathPatterns are regular expressions matched against the route template and
+	// the URL path of the requests which are not instrumented, e.g. "^/static/".
+	IgnorePathPatterns []string
+	// RouteAllowList are the only routes instrumented when set, by route template, route name
+	// or path label; the other requests are served without being recorded. IgnorePaths and
+	// IgnorePathPatterns still apply to the allowed routes. The route of a request served by a
+	// wrapped net/http.ServeMux is only known once it returns, so such requests count as in
+	// flight even when their route turns out not to be allowed.
+	RouteAllowList []string
+	// SkipPreflight serves the CORS preflight requests, OPTIONS requests carrying an
+	// Access-Control-Request-Method header, without recording them.
+	SkipPreflight bool
+	// CollapsePreflight records the CORS preflight requests under the "preflight" path label
+	// instead of the path of their route, keeping them out of the distributions of the routes.
+	// SkipPreflight takes precedence.
+	CollapsePreflight bool
+	// PathLabelFunc returns the path label of the request, replacing the template of the
+	// gorilla/mux route, the net/http.ServeMux pattern and the templated URL path. It must
+	// return values from a bounded set.
+	PathLabelFunc func(r *http.Request) string
+	// PathLabelSources resolve the path label of the requests in order, until one returns a
+	// non-empty path, e.g. MuxRouteName, then MuxRouteTemplate, then StdlibPatternPath, then
+	// ConstantPath("other"). The path label is "unknown" when none does. When empty, the path
+	// label is resolved by PathLabelFunc, or else the gorilla/mux route template, the
+	// net/http.ServeMux pattern and the templated URL path in that order.
+	PathLabelSources []PathSource
+	// AutoTemplatePatterns are the patterns, by placeholder name, templating the URL path used as the
+	// path label of the requests not served by a gorilla/mux route: each path segment matching a pattern
+	// is replaced by ":" followed by its name, e.g. "/users/42" becomes "/users/:id". Defaults to
+	// DefaultAutoTemplatePatterns. Every segment is matched against the patterns on every such request.
+	AutoTemplatePatterns map[string]*regexp.Regexp
+	// PathRedactor rewrites the path label, after PathPrefixStrip and LowercasePath, e.g. to
+	// remove sensitive segments from route templates. The label is recorded as is when nil.
+	PathRedactor func(path string) string
+	// PathAllowList are the only path labels recorded verbatim when set, others are recorded
+	// as "redacted". It applies to the output of PathRedactor.
+	PathAllowList []string
+	// MaxDistinctPaths caps the number of distinct path labels, as a safety net against runaway
+	// series. Once reached, requests of paths not seen yet are recorded as "overflow". The first
+	// paths seen are kept, there is no eviction.
+	MaxDistinctPaths int
+	// QueryParamLabels are the query parameters, like "type" in "/search?type=image", added as
+	// labels to the request counter and duration histogram, named "query_" followed by the
+	// parameter. Only the values listed for the parameter in QueryParamValues are recorded, others
+	// are recorded as "other" and a missing parameter as "none". The characters invalid in label
+	// names are replaced by "_", and a parameter whose label is the one of a previous parameter is
+	// logged and dropped.
+	QueryParamLabels []string
+	// QueryParamValues are the values allowed per parameter of QueryParamLabels. A parameter
+	// without values is always recorded as "other" or "none".
+	QueryParamValues map[string][]string
+	// NotFoundPath is the path label of the requests matching no gorilla/mux route, recorded with
+	// InstrumentUnmatched or InstrumentRouter. Defaults to "not_found".
+	NotFoundPath string
+	// MethodNotAllowedPath is the path label of the requests matching a gorilla/mux route but not
+	// its methods, recorded with InstrumentUnmatched or InstrumentRouter. Defaults to "method_not_allowed".
+	MethodNotAllowedPath string
+	// ResolveMethodNotAllowedRoutes labels the 405 responses of InstrumentRouter and
+	// InstrumentUnmatched with the template of the route whose methods did not match, rather
+	// than MethodNotAllowedPath. The route is found by matching the request again with each
+	// standard method, so it only costs on 405 responses.
+	ResolveMethodNotAllowedRoutes bool
+	// DisableAutoTemplate uses the raw URL path as the path label of the requests not served by a gorilla/mux route.
+	DisableAutoTemplate bool
+	// LowercasePath lowercases the path label, so that templates differing only by case share their series.
+	LowercasePath bool
+	// SlowRequestThreshold is the duration above which a request is considered slow.
+	SlowRequestThreshold time.Duration
+	// SlowRequestLogger logs a line for every request slower than SlowRequestThreshold, with its
+	// method, path, status code, duration and the labels returned by ExemplarLabels, like its
+	// trace ID. Lines are logged from a single background goroutine, so that a slow Logger does
+	// not slow the request down further; the lines arriving while 256 of them are waiting are
+	// dropped, and counted by SelfMetrics. Shutdown logs the lines left.
+	SlowRequestLogger Logger
+	// EmitLatencyMillis adds the http_request_duration_milliseconds histogram, observing the same
+	// durations in milliseconds with the same labels as the duration histogram, whose buckets are
+	// converted to milliseconds. It eases migrating dashboards and alerts between units.
+	EmitLatencyMillis bool
+	// MeasureUntilFlushed flushes the response of a streaming handler, one which flushed it itself,
+	// once it returns and before stopping the latency clock, so that the duration includes handing
+	// the rest of the stream buffered by the server, or by wrappers supporting http.Flusher, to the
+	// connection. Other responses are left alone, as flushing them would replace their
+	// Content-Length by chunked encoding. The kernel send buffer still hides when the client
+	// actually receives the data. Hijacked connections, and handlers flushing an
+	// Opts.WrapResponseWriter, are not flushed.
+	MeasureUntilFlushed bool
+	// AlsoRecordLatencySummary adds the http_request_duration_summary_seconds summary, observing
+	// the same durations and with the same labels as the duration histogram, for quantiles
+	// accurate per instance but which cannot be aggregated across instances.
+	AlsoRecordLatencySummary bool
+	// LatencySummaryObjectives specifies the quantile objectives of the duration summary.
+	LatencySummaryObjectives map[float64]float64
+	// LatencyByOutcome adds the http_request_outcome_duration_seconds histogram, partitioned by
+	// path and by the outcome of the request rather than its status code: "success" below 400,
+	// "client_error" for 4xx and "server_error" for 5xx.
+	LatencyByOutcome bool
+	// MaxLatencyClamp caps the durations observed by the latency collectors, so that a stuck
+	// request lasting hours doesn't distort their sums and averages: longer requests are observed
+	// with MaxLatencyClamp, in the bucket holding it or +Inf. The time to first byte, time to
+	// headers, body read and phase durations are capped the same way. The scheduling delay and
+	// deadline slack are not, as they are not spent serving the request. Logs and annotations
+	// keep the raw duration. Defaults to no clamp.
+	MaxLatencyClamp time.Duration
+	// CountClampedLatencies adds the http_request_latency_clamped_total counter of the durations
+	// capped by MaxLatencyClamp, partitioned by HTTP path.
+	CountClampedLatencies bool
+	// FineLatencyBuckets are the buckets of the http_request_fine_duration_seconds histogram,
+	// which only observes the requests of the FineLatencyRoutes in addition to the
+	// regular duration histogram, for high resolution only where it is worth the series.
+	FineLatencyBuckets []float64
+	// FineLatencyRoutes are the path labels observed in the fine duration histogram.
+	FineLatencyRoutes []string
+	// Phases are the phases of a request, like "auth", "db" or "render", that handlers
+	// time with the PhaseTimer of the request context. When set, their durations are
+	// observed in the http_request_phase_duration_seconds histogram. Other phases are dropped.
+	Phases []string
+	// TrackSlowestRequest adds the http_slowest_request_seconds gauge holding, per path,
+	// the longest duration observed since the previous scrape.
+	TrackSlowestRequest bool
+	// TrackLatencyQuantiles adds the http_request_latency_quantile gauge holding, per path, the
+	// 0.5, 0.9, 0.99 and 0.999 quantiles of the durations observed since the start, estimated by
+	// a t-digest of bounded memory. Unlike the histogram buckets, these quantiles are accurate
+	// at the tail but cannot be aggregated across instances. It costs a digest per path.
+	TrackLatencyQuantiles bool
+	// TrackTimeToFirstByte adds the http_time_to_first_byte_seconds histogram, observing
+	// how long the handler took until the first write of the response body, which unlike
+	// the total duration does not depend on how fast the client downloads the response.
+	TrackTimeToFirstByte bool
+	// TrackTimeToHeaders adds the http_time_to_headers_seconds histogram, observing how long the
+	// handler took until writing the status, with WriteHeader or implicitly on the first Write,
+	// which tells the handlers delaying the status apart from those slow to write the body.
+	TrackTimeToHeaders bool
+	// TrackDeadlineSlack adds the http_request_deadline_slack_seconds histogram, observing how much
+	// of the deadline of the request context was left when the handler returned, to right-size
+	// timeouts. Requests which overran their deadline are observed as 0, in the first bucket, and
+	// requests without a deadline are not observed.
+	TrackDeadlineSlack bool
+	// TrackSchedulingDelay adds the http_scheduling_delay_seconds histogram, observing how long the
+	// requests waited between the enqueue time of their context, set by ConnContext or
+	// ContextWithEnqueueTime, and the start of the middleware. From the accept of the connection
+	// as set by ConnContext, the delay also holds the TLS handshake and the time the client took
+	// to send its request, so it is not a measure of CPU starvation; set the enqueue time with
+	// ContextWithEnqueueTime where the request is actually queued, e.g. by a load-shedding
+	// handler in front of the middleware, for that. Requests without an enqueue time are not
+	// observed.
+	TrackSchedulingDelay bool
+	// SchedulingDelayBuckets are the buckets of the scheduling delay histogram. Defaults to 100µs,
+	// 500µs, 1ms, 5ms, 10ms, 50ms, 100ms, 500ms and 1s.
+	SchedulingDelayBuckets []float64
+	// TrackBodyReadDuration adds the http_request_body_read_seconds histogram, observing how long
+	// it took from the first to the last read of the request body, which tells slow uploads apart
+	// from slow handlers. Requests whose body is not read by the handler are not observed.
+	TrackBodyReadDuration bool
+	// LabelSlowRequests adds a "slow" label to the request duration histogram
+	// which is "true" for requests that took longer than SlowRequestThreshold.
+	LabelSlowRequests bool
+	// WarmupDuration is how long after the creation of the middleware, according to Now, the
+	// requests are considered part of the warm-up, with cold caches and connection pools. The
+	// requests completing during the warm-up are not recorded, unless LabelWarmup is set.
+	WarmupDuration time.Duration
+	// LabelWarmup records the requests completing during WarmupDuration rather than skipping them,
+	// with a "warmup" label of "true" on the request counter and the latency histogram.
+	LabelWarmup bool
+	// Registerers are the registries every collector is registered into.
+	// Defaults to prometheus.DefaultRegisterer.
+	Registerers []prometheus.Registerer
+	// RequestCounter is an existing counter the requests are counted into instead of a new
+	// http_requests_total counter, e.g. one shared by every service of a stack. It must have the
+	// label names of the request counter, in any order: code, method and path, plus the optional
+	// labels the other options add. It is neither registered nor unregistered by the middleware. A counter
+	// with other label names is logged and replaced by a new counter.
+	RequestCounter *prometheus.CounterVec
+	// LatencyHistogram is an existing histogram the request durations are observed into instead
+	// of a new http_request_duration_seconds histogram, with the label names of the latency
+	// histogram, like RequestCounter. Buckets is ignored.
+	LatencyHistogram *prometheus.HistogramVec
+	// PoolResponseWriters reuses the ResponseWriter wrappers across requests to save an
+	// allocation per request. Handlers must not retain the ResponseWriter once they returned.
+	PoolResponseWriters bool
+	// LazyRegister defers the registration of the collectors until the first instrumented request.
+	LazyRegister bool
+	// PushGrouping specifies the grouping labels used by PushTo.
+	PushGrouping map[string]string
+	// TrackSizeRatio adds the http_response_request_size_ratio histogram, observing the
+	// response size divided by the request size to highlight amplification hotspots.
+	TrackSizeRatio bool
+	// TrackHeaderBytes adds the http_request_header_bytes and http_response_header_bytes
+	// histograms, observing the size of the headers separately from the body.
+	TrackHeaderBytes bool
+	// TrackHeaderSizes are the headers, like Cookie or Authorization, whose size is observed in the
+	// http_header_bytes histogram partitioned by header. A header is looked up in the request, then
+	// in the response for response headers like Set-Cookie, and not observed when absent.
+	TrackHeaderSizes []string
+	// RateLimitRemainingHeader is the response header, like X-RateLimit-Remaining, holding the quota
+	// left to the client. When set, the http_ratelimit_remaining gauge holds per path the value of the
+	// latest response. Responses without a valid value leave the gauge unchanged.
+	RateLimitRemainingHeader string
+	// SkipStreamingResponses skips the duration and size observations of server-sent events
+	// responses (Content-Type text/event-stream), which last as long as the connection.
+	// They are still counted in http_requests_total.
+	SkipStreamingResponses bool
+	// ConcurrencyLimitHeader is the response header, like X-Concurrency-Limited, set when a
+	// request is rejected by a concurrency limit. When set, the http_concurrency_rejected_total
+	// counter is incremented for responses with ConcurrencyRejectedCode carrying the header.
+	ConcurrencyLimitHeader string
+	// ConcurrencyRejectedCode is the status code of requests rejected by a concurrency limit.
+	// Defaults to 503.
+	ConcurrencyRejectedCode int
+	// RequiredHeaders are the request headers every client is expected to send. When set,
+	// the http_requests_missing_header_total counter is incremented for each of them
+	// missing from a request. Requests are not rejected.
+	RequiredHeaders []string
+	// CountTLSVersions adds the http_requests_by_tls_version_total counter partitioned by
+	// the negotiated TLS version ("1.0" to "1.3", "none" for plaintext requests).
+	CountTLSVersions bool
+	// CountTLSResumptions adds the http_tls_resumed_total and http_tls_full_handshake_total
+	// counters of the TLS requests, telling whether their connection resumed a TLS session, to
+	// measure how effective the session cache is. Plaintext requests are not counted. As every
+	// request of a connection counts, the counters weigh connections by their number of requests.
+	CountTLSResumptions bool
+	// ExemplarLabels returns the labels, e.g. a trace ID, of the exemplar attached to
+	// latency observations of requests slower than ExemplarThreshold. No exemplar is
+	// attached when it is nil or returns no labels.
+	ExemplarLabels func(ctx context.Context) prometheus.Labels
+	// ExemplarThreshold is the duration a request must exceed to get an exemplar.
+	ExemplarThreshold time.Duration
+	// ExemplarSampleRate is the probability, between 0 and 1, that a request slower than
+	// ExemplarThreshold gets an exemplar. Both filters must pass, which bounds the exemplars of
+	// endpoints that are constantly slow. Zero keeps every exemplar, like 1.
+	ExemplarSampleRate float64
+	// RecordOnlyIfSampled only attaches exemplars to the requests whose trace is sampled according
+	// to IsSampled, so that every exemplar links to a trace which was kept.
+	RecordOnlyIfSampled bool
+	// IsSampled reports whether the trace of the request context is sampled, e.g.
+	// prometheusotel.IsSampled. Requests are considered unsampled when it is nil.
+	IsSampled func(ctx context.Context) bool
+	// Annotate is called with what was recorded once a request has been served,
+	// e.g. to set attributes on the active tracing span (see the otel subpackage).
+	Annotate func(r *http.Request, info RequestInfo)
+	// HandlerNameFunc returns the name of the handler serving the request, e.g.
+	// RouteHandlerName. When set, a "handler" label is added to the request counter
+	// and duration histogram. Handler names must form a bounded set.
+	HandlerNameFunc func(r *http.Request) string
+	// OperationLabelFunc returns the operation of the request, e.g. the GraphQL operation name
+	// read from a header, for APIs serving many operations under a single path. When set, an
+	// "operation" label is added to the request counter and duration histogram. It is called
+	// once the handler returned and must return values from a bounded set, like "other" for
+	// unknown operations.
+	OperationLabelFunc func(r *http.Request) string
+	// RouteIdentityFunc returns the identity of the route of the request, e.g. the name of the
+	// router mounting it joined to its name, to tell apart the routes of composed routers whose
+	// names collide or are empty. When set, a "route" label is added to the request counter and
+	// duration histogram, holding the path label when it returns "". It is called once the
+	// handler returned, also for requests served by no gorilla/mux route, and must return values
+	// from a bounded set.
+	RouteIdentityFunc func(r *http.Request) string
+	// LabelConditionalRequests adds a "conditional" label to the request counter, which is "true"
+	// for requests with an If-None-Match or If-Modified-Since header. Along with the 304 code,
+	// it tells how often cache validations succeed.
+	LabelConditionalRequests bool
+	// LabelAllowedMethods adds an "allowed_methods" label to the request counter with the
+	// methods declared by the matched gorilla/mux route (e.g. "get,post"), or "any".
+	LabelAllowedMethods bool
+	// LabelProtocol adds a "proto" label (http/1.0, http/1.1, http/2, http/3 or other)
+	// to the request counter and duration histogram.
+	LabelProtocol bool
+	// CacheStatusHeader is the response header, like X-Cache, telling whether the response
+	// was served from cache. When set, a "cache" label (HIT, MISS, other or none when
+	// the header is missing) is added to the request counter.
+	CacheStatusHeader string
+	// CircuitHeader is the response header, like X-Circuit, set by a circuit breaker on the
+	// requests it short-circuits. When set, a "circuit" label ("open", "half_open", "other", or
+	// "none" when the header is missing) is added to the request counter and the latency
+	// histogram, telling the rejections of the breaker apart from the errors of the handler. The
+	// breaker must be wrapped by the middleware for its responses to be recorded.
+	CircuitHeader string
+	// CountCacheValidators adds the http_responses_by_validator_total counter partitioned by path
+	// and "cacheable" label, which is "has-validator" for responses carrying an ETag or a
+	// Last-Modified header and "none" otherwise. It points at the routes which could answer
+	// conditional requests with 304.
+	CountCacheValidators bool
+	// FeatureFlagHeader is the request header, like X-Feature-Flag, telling whether a feature is
+	// enabled for the request. When set, a "feature" label ("on", "off", or "absent" when the
+	// header is missing or neither true nor false) is added to the request counter and the
+	// latency histogram, to compare both cohorts.
+	FeatureFlagHeader string
+	// TrackAcceptHeader adds an "accept" label to the request counter, classifying the first media
+	// type of the Accept header of the request into "json", "xml", "html" or "other", and "any"
+	// when the header is missing or accepts "*/*".
+	TrackAcceptHeader bool
+	// RateWindow adds the http_requests_per_second gauge, holding the average request rate over
+	// a window of that duration, rounded to the second and moved every second by a background
+	// goroutine. Call Shutdown to stop the goroutine.
+	RateWindow time.Duration
+	// DistinctClientKeyFunc adds the http_distinct_clients_estimate gauge, estimating how many
+	// distinct keys, like the client IP or an API key header, it returned since the start. The
+	// estimate comes from a HyperLogLog of 16KiB with a standard error of about 0.8%, so the keys
+	// add no cardinality. Requests with an empty key are not counted.
+	DistinctClientKeyFunc func(r *http.Request) string
+	// SelfMetrics registers the metrics about the middleware itself, telling what it lost:
+	// prometheus_middleware_dropped_observations_total counts the observations dropped by the
+	// async recorder, prometheus_middleware_dropped_slow_request_logs_total the lines dropped by
+	// SlowRequestLogger, prometheus_middleware_path_overflow_total the requests whose path was
+	// collapsed by MaxDistinctPaths and prometheus_middleware_registration_errors_total the
+	// collectors which failed to register.
+	SelfMetrics bool
+	// TrackOldestInFlight adds the http_oldest_inflight_request_seconds gauge, holding the age of
+	// the oldest request being served when scraped, which keeps growing while a request is stuck.
+	// Requests ignored by the middleware are not tracked.
+	TrackOldestInFlight bool
+	// TrackInFlightByPath adds the http_requests_in_flight gauge, holding the number of requests
+	// being served partitioned by HTTP path and method, which tells which endpoints are saturated.
+	// A gauge per path and method adds as many series as the request counter. With InstrumentRouter,
+	// only the requests served by a route are tracked, once the route matched. The requests whose
+	// path is only known once the handler returns, like those of a wrapped net/http.ServeMux, are
+	// tracked under the "pending" path, rather than a series per raw URL path.
+	TrackInFlightByPath bool
+	// AsyncBufferSize records the requests on a background goroutine, through a buffer of that
+	// many requests, rather than on the goroutine serving them. Requests arriving while the
+	// buffer is full are dropped and counted by http_async_dropped_observations_total.
+	// Call Shutdown to stop the goroutine.
+	AsyncBufferSize int
+	// Logger logs the warnings of the middleware, like collectors which failed to register.
+	// Defaults to the standard logger of the log package.
+	Logger Logger
+	// Now returns the current time, used to measure request durations. Defaults to time.Now.
+	Now func() time.Time
+	// RegionClassifier maps the client IP to a region. When set, a "region" label
+	// is added to the request counter. Values outside of Regions collapse to "unknown".
+	RegionClassifier func(ip net.IP) string
+	// Regions is the fixed set of values the region label can take.
+	Regions []string
+	// TrustedProxyHeader is the header, like X-Forwarded-For, holding the client IP
+	// when the request comes from one of the TrustedProxies.
+	TrustedProxyHeader string
+	// TrustedProxies are the CIDRs of the proxies allowed to set TrustedProxyHeader.
+	TrustedProxies []string
+}
+
+// RequestInfo describes what was recorded for a request.
+type RequestInfo struct {
+	// Path is the value of the path label.
+	Path string
+	// Code is the status code of the response.
+	Code int
+	// Duration is how long the handler took to run.
+	Duration time.Duration
+	// RequestSize is the approximate size of the request.
+	RequestSize int
+	// ResponseSize is the number of bytes written in the response body.
+	ResponseSize int64
 }
 
 // PrometheusMiddleware specifies the metrics that is going to be generated
 type PrometheusMiddleware struct {
-	request *prometheus.CounterVec
-	latency *prometheus.HistogramVec
-	reqSize *prometheus.HistogramVec
-	resSize *prometheus.HistogramVec
+	opts       Opts
+	collectors []namedCollector
+	lazyOnce   sync.Once
+	unrouted   sync.Once
+	regions    *regionClassifier
+	ignore     *pathFilter
+	templater  pathTemplater
+	allowed    map[string]struct{}
+	paths      *pathLimiter
+	queries    []queryLabel
+	detailed   map[int]struct{}
+	routes     routeAllowList
+	self       *selfMetrics
+	panics     *prometheus.CounterVec
+	random     func() float64
+	started    time.Time
+	request    *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	ttfb       *prometheus.HistogramVec
+	bodyRead   *prometheus.HistogramVec
+	headers    *prometheus.HistogramVec
+	slack      *prometheus.HistogramVec
+	delay      prometheus.Histogram
+	fine       *prometheus.HistogramVec
+	outcome    *prometheus.HistogramVec
+	latencySum *prometheus.SummaryVec
+	latencyMs  *prometheus.HistogramVec
+	slowest    *slowestCollector
+	digests    *quantileCollector
+	phase      *prometheus.HistogramVec
+	phases     map[string]struct{}
+	async      *asyncRecorder
+	slow       *slowLogger
+	capturing  sync.Map // *mux.Router -> struct{}, of the routers running captureRoute
+	fineRoutes map[string]struct{}
+	reqSize    prometheus.ObserverVec
+	resSize    prometheus.ObserverVec
+	inflated   prometheus.ObserverVec
+	reqBytes   *prometheus.CounterVec
+	resBytes   *prometheus.CounterVec
+	sizeRatio  *prometheus.HistogramVec
+	tlsVersion *prometheus.CounterVec
+	tlsResumed prometheus.Counter
+	tlsFull    prometheus.Counter
+	rejected   *prometheus.CounterVec
+	missing    *prometheus.CounterVec
+	validators *prometheus.CounterVec
+
+	reqHeaderSize *prometheus.HistogramVec
+	resHeaderSize *prometheus.HistogramVec
+	headerBytes   *prometheus.HistogramVec
+	rateLimit     *prometheus.GaugeVec
+	truncated     *prometheus.CounterVec
+	clamped       *prometheus.CounterVec
+	rate          *rateWindow
+	clients       *distinctCounter
+	inflight      *inflightRequests
+	concurrent    *prometheus.GaugeVec
+
+	requestLabels []string
+	latencyLabels []string
+	resSizeLabels []string
 }
 
 // NewPrometheusMiddleware creates a new PrometheusMiddleware instance
 func NewPrometheusMiddleware(opts Opts) *PrometheusMiddleware {
-	var prometheusMiddleware PrometheusMiddleware
+	if len(opts.Registerers) == 0 {
+		opts.Registerers = []prometheus.Registerer{prometheus.DefaultRegisterer}
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.NotFoundPath == "" {
+		opts.NotFoundPath = "not_found"
+	}
+	if opts.MethodNotAllowedPath == "" {
+		opts.MethodNotAllowedPath = "method_not_allowed"
+	}
+	if opts.AddHostnameLabel {
+		opts.ConstLabels = withHostnameLabel(opts)
+	}
+	if opts.DeploymentLabel != "" {
+		opts.ConstLabels = withConstLabel(opts.ConstLabels, "deployment", opts.DeploymentLabel)
+	}
+	prometheusMiddleware := PrometheusMiddleware{opts: opts, random: rand.Float64}
+	if opts.WarmupDuration > 0 {
+		prometheusMiddleware.started = opts.Now()
+	}
+	if opts.SelfMetrics {
+		prometheusMiddleware.self = newSelfMetrics(opts)
+	}
 
 	counterOpts := prometheus.CounterOpts{
-		Name:      requestName,
-		Help:      "How many HTTP requests processed, partitioned by status code, method and HTTP path.",
-		Subsystem: opts.Subsystem,
+		Namespace:   opts.Namespace,
+		Name:        requestName,
+		Help:        "How many HTTP requests processed, partitioned by status code, method and HTTP path.",
+		Subsystem:   opts.Subsystem,
+		ConstLabels: opts.ConstLabels,
 	}
-	prometheusMiddleware.request = prometheus.NewCounterVec(
-		counterOpts,
-		[]string{"code", "method", "path"},
-	)
+	if opts.RegionClassifier != nil {
+		prometheusMiddleware.regions = newRegionClassifier(opts)
+	}
+	prometheusMiddleware.routes = newRouteAllowList(opts.RouteAllowList)
+	if len(opts.IgnorePaths) > 0 || len(opts.IgnorePathPatterns) > 0 {
+		prometheusMiddleware.ignore = newPathFilter(opts)
+	}
+	prometheusMiddleware.templater = newPathTemplater(opts)
+	if opts.MaxDistinctPaths > 0 {
+		prometheusMiddleware.paths = newPathLimiter(opts.MaxDistinctPaths)
+	}
+	if len(opts.PathAllowList) > 0 {
+		prometheusMiddleware.allowed = make(map[string]struct{}, len(opts.PathAllowList))
+		for _, path := range opts.PathAllowList {
+			prometheusMiddleware.allowed[path] = struct{}{}
+		}
+	}
+	if len(opts.DetailedCodes) > 0 {
+		prometheusMiddleware.detailed = make(map[int]struct{}, len(opts.DetailedCodes))
+		for _, code := range opts.DetailedCodes {
+			prometheusMiddleware.detailed[code] = struct{}{}
+		}
+	}
+	prometheusMiddleware.queries = newQueryLabels(opts)
+	prometheusMiddleware.initLabels()
 
-	if err := prometheus.Register(prometheusMiddleware.request); err != nil {
-		log.Println("prometheusMiddleware.request was not registered:", err)
+	if opts.RequestCounter != nil && prometheusMiddleware.hasLabels("RequestCounter", opts.RequestCounter.MetricVec, prometheusMiddleware.requestLabels) {
+		prometheusMiddleware.request = opts.RequestCounter
+	} else {
+		prometheusMiddleware.request = prometheus.NewCounterVec(
+			counterOpts,
+			prometheusMiddleware.requestLabels,
+		)
+
+		prometheusMiddleware.register("request", prometheusMiddleware.request)
 	}
 
 	buckets := opts.Buckets
@@ -62,117 +686,1162 @@ func NewPrometheusMiddleware(opts Opts) *PrometheusMiddleware {
 	}
 
 	histogramOpts := prometheus.HistogramOpts{
-		Name:      latencyName,
-		Help:      "How long it took to process the request, partitioned by status code, method and HTTP path.",
-		Buckets:   buckets,
-		Subsystem: opts.Subsystem,
-	}
-	prometheusMiddleware.latency = prometheus.NewHistogramVec(
-		histogramOpts,
-		[]string{"code", "method", "path"},
-	)
+		Namespace:   opts.Namespace,
+		Name:        latencyName,
+		Help:        "How long it took to process the request, partitioned by status code, method and HTTP path.",
+		Buckets:     buckets,
+		Subsystem:   opts.Subsystem,
+		ConstLabels: opts.ConstLabels,
+	}
+	if opts.LatencyHistogram != nil && prometheusMiddleware.hasLabels("LatencyHistogram", opts.LatencyHistogram.MetricVec, prometheusMiddleware.latencyLabels) {
+		prometheusMiddleware.latency = opts.LatencyHistogram
+	} else {
+		prometheusMiddleware.latency = prometheus.NewHistogramVec(
+			histogramOpts,
+			prometheusMiddleware.latencyLabels,
+		)
 
-	if err := prometheus.Register(prometheusMiddleware.latency); err != nil {
-		log.Println("prometheusMiddleware.latency was not registered:", err)
+		prometheusMiddleware.register("latency", prometheusMiddleware.latency)
 	}
 
-	reqSizeOpts := prometheus.HistogramOpts{
-		Name:    requestSizeName,
-		Help:    "How large was the request, partitioned by status code, method and HTTP path.",
-		Buckets: []float64{100, 1000, 5000, 20000, 50000},
+	if opts.EmitLatencyMillis {
+		millisBuckets := make([]float64, len(buckets))
+		for i, bucket := range buckets {
+			millisBuckets[i] = bucket * 1000
+		}
+
+		prometheusMiddleware.latencyMs = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Name:        latencyMillisName,
+				Help:        "How long it took to process the request in milliseconds, partitioned by status code, method and HTTP path.",
+				Buckets:     millisBuckets,
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			prometheusMiddleware.latencyLabels,
+		)
+		prometheusMiddleware.register("latencyMillis", prometheusMiddleware.latencyMs)
+	}
+
+	if opts.AlsoRecordLatencySummary {
+		objectives := opts.LatencySummaryObjectives
+		if len(objectives) == 0 {
+			objectives = dflLatencyObjectives
+		}
+
+		prometheusMiddleware.latencySum = prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace:   opts.Namespace,
+				Name:        latencySummaryName,
+				Help:        "How long it took to process the request, partitioned by status code, method and HTTP path.",
+				Objectives:  objectives,
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			prometheusMiddleware.latencyLabels,
+		)
+		prometheusMiddleware.register("latencySummary", prometheusMiddleware.latencySum)
+	}
+
+	if opts.LatencyByOutcome {
+		prometheusMiddleware.outcome = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Name:        outcomeName,
+				Help:        "How long it took to process the request, partitioned by outcome and HTTP path.",
+				Buckets:     buckets,
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"outcome", "path"},
+		)
+		prometheusMiddleware.register("outcome", prometheusMiddleware.outcome)
+	}
+
+	if len(opts.FineLatencyBuckets) > 0 && len(opts.FineLatencyRoutes) > 0 {
+		prometheusMiddleware.fineRoutes = make(map[string]struct{}, len(opts.FineLatencyRoutes))
+		for _, route := range opts.FineLatencyRoutes {
+			prometheusMiddleware.fineRoutes[route] = struct{}{}
+		}
+		prometheusMiddleware.fine = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Name:        fineLatencyName,
+				Help:        "How long it took to process the request of critical routes, partitioned by status code, method and HTTP path.",
+				Buckets:     opts.FineLatencyBuckets,
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			defaultLabels,
+		)
+		prometheusMiddleware.register("fine", prometheusMiddleware.fine)
+	}
+
+	if len(opts.Phases) > 0 {
+		prometheusMiddleware.phases = make(map[string]struct{}, len(opts.Phases))
+		for _, phase := range opts.Phases {
+			prometheusMiddleware.phases[phase] = struct{}{}
+		}
+		prometheusMiddleware.phase = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Name:        phaseName,
+				Help:        "How long the phases of the request took, partitioned by HTTP path and phase.",
+				Buckets:     buckets,
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path", "phase"},
+		)
+		prometheusMiddleware.register("phase", prometheusMiddleware.phase)
+	}
+
+	if opts.TrackSlowestRequest {
+		prometheusMiddleware.slowest = newSlowestCollector(opts)
+		prometheusMiddleware.register("slowest", prometheusMiddleware.slowest)
+	}
+
+	if opts.TrackLatencyQuantiles {
+		prometheusMiddleware.digests = newQuantileCollector(opts)
+		prometheusMiddleware.register("digests", prometheusMiddleware.digests)
 	}
-	prometheusMiddleware.reqSize = prometheus.NewHistogramVec(
-		reqSizeOpts,
-		[]string{"code", "method", "path"},
-	)
 
-	if err := prometheus.Register(prometheusMiddleware.reqSize); err != nil {
-		log.Println("prometheusMiddleware.reqSize was not registered:", err)
+	if opts.TrackTimeToFirstByte {
+		prometheusMiddleware.ttfb = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Name:        ttfbName,
+				Help:        "How long it took to write the first byte of the response body, partitioned by status code, method and HTTP path.",
+				Buckets:     buckets,
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			defaultLabels,
+		)
+		prometheusMiddleware.register("ttfb", prometheusMiddleware.ttfb)
 	}
 
-	resSizeOpts := prometheus.HistogramOpts{
-		Name:    responseSizeName,
-		Help:    "How large was the response, partitioned by status code, method and HTTP path.",
-		Buckets: []float64{100, 1000, 5000, 20000, 50000},
+	if opts.TrackTimeToHeaders {
+		prometheusMiddleware.headers = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Name:        headersTimeName,
+				Help:        "How long it took to write the status of the response, partitioned by status code, method and HTTP path.",
+				Buckets:     buckets,
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			defaultLabels,
+		)
+		prometheusMiddleware.register("headers", prometheusMiddleware.headers)
 	}
-	prometheusMiddleware.resSize = prometheus.NewHistogramVec(
-		resSizeOpts,
-		[]string{"code", "method", "path"},
+
+	if opts.TrackDeadlineSlack {
+		prometheusMiddleware.slack = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Name:        deadlineSlackName,
+				Help:        "How much of the deadline of the request was left when the handler returned, partitioned by status code, method and HTTP path.",
+				Buckets:     overrunBuckets(buckets),
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			defaultLabels,
+		)
+		prometheusMiddleware.register("slack", prometheusMiddleware.slack)
+	}
+
+	if opts.TrackSchedulingDelay {
+		delayBuckets := opts.SchedulingDelayBuckets
+		if len(delayBuckets) == 0 {
+			delayBuckets = dflDelayBuckets
+		}
+		prometheusMiddleware.delay = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Name:        schedulingDelayName,
+			Help:        "How long the HTTP requests waited to be served once ready.",
+			Buckets:     delayBuckets,
+			Subsystem:   opts.Subsystem,
+			ConstLabels: opts.ConstLabels,
+		})
+		prometheusMiddleware.register("delay", prometheusMiddleware.delay)
+	}
+
+	if opts.TrackBodyReadDuration {
+		prometheusMiddleware.bodyRead = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Name:        bodyReadName,
+				Help:        "How long it took to read the request body, partitioned by status code, method and HTTP path.",
+				Buckets:     buckets,
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			defaultLabels,
+		)
+		prometheusMiddleware.register("bodyRead", prometheusMiddleware.bodyRead)
+	}
+
+	// The request and response sizes have always been named outside of the Subsystem.
+	prometheusMiddleware.reqSize = newSizeVec(
+		opts,
+		"",
+		sizeObserver(opts, opts.RequestSizeObserver),
+		requestSizeName,
+		"How large was the request, partitioned by status code, method and HTTP path.",
+		defaultLabels,
 	)
 
-	if err := prometheus.Register(prometheusMiddleware.resSize); err != nil {
-		log.Println("prometheusMiddleware.resSize was not registered:", err)
+	prometheusMiddleware.register("reqSize", prometheusMiddleware.reqSize)
+
+	prometheusMiddleware.resSize = newSizeVec(
+		opts,
+		"",
+		sizeObserver(opts, opts.ResponseSizeObserver),
+		responseSizeName,
+		"How large was the response, partitioned by status code, method and HTTP path.",
+		prometheusMiddleware.resSizeLabels,
+	)
+
+	prometheusMiddleware.register("resSize", prometheusMiddleware.resSize)
+
+	if opts.TrackDecompressedRequestSize {
+		prometheusMiddleware.inflated = newSizeVec(
+			opts,
+			opts.Subsystem,
+			sizeObserver(opts, opts.RequestSizeObserver),
+			decompressedSizeName,
+			"How large was the decompressed request body, partitioned by status code, method and HTTP path.",
+			defaultLabels,
+		)
+		prometheusMiddleware.register("inflated", prometheusMiddleware.inflated)
+	}
+
+	if opts.CountBytes {
+		prometheusMiddleware.reqBytes = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        requestBytesName,
+				Help:        "How many bytes of HTTP requests were received, partitioned by HTTP path.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path"},
+		)
+		prometheusMiddleware.register("reqBytes", prometheusMiddleware.reqBytes)
+
+		prometheusMiddleware.resBytes = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        responseBytesName,
+				Help:        "How many bytes of HTTP responses were sent, partitioned by HTTP path.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path"},
+		)
+		prometheusMiddleware.register("resBytes", prometheusMiddleware.resBytes)
+	}
+
+	if opts.TrackSizeRatio {
+		prometheusMiddleware.sizeRatio = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Subsystem:   opts.Subsystem,
+				Name:        sizeRatioName,
+				Help:        "How many times larger than the request was the response, partitioned by status code, method and HTTP path.",
+				Buckets:     dflRatioBuckets,
+				ConstLabels: opts.ConstLabels,
+			},
+			defaultLabels,
+		)
+		prometheusMiddleware.register("sizeRatio", prometheusMiddleware.sizeRatio)
+	}
+
+	if opts.TrackHeaderBytes {
+		prometheusMiddleware.reqHeaderSize = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Subsystem:   opts.Subsystem,
+				Name:        requestHeaderSizeName,
+				Help:        "How large were the request headers, partitioned by status code, method and HTTP path.",
+				Buckets:     dflHeaderBuckets,
+				ConstLabels: opts.ConstLabels,
+			},
+			defaultLabels,
+		)
+		prometheusMiddleware.register("reqHeaderSize", prometheusMiddleware.reqHeaderSize)
+
+		prometheusMiddleware.resHeaderSize = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Subsystem:   opts.Subsystem,
+				Name:        responseHeaderSizeName,
+				Help:        "How large were the response headers, partitioned by status code, method and HTTP path.",
+				Buckets:     dflHeaderBuckets,
+				ConstLabels: opts.ConstLabels,
+			},
+			defaultLabels,
+		)
+		prometheusMiddleware.register("resHeaderSize", prometheusMiddleware.resHeaderSize)
+	}
+
+	if len(opts.TrackHeaderSizes) > 0 {
+		prometheusMiddleware.opts.TrackHeaderSizes = make([]string, len(opts.TrackHeaderSizes))
+		for i, header := range opts.TrackHeaderSizes {
+			prometheusMiddleware.opts.TrackHeaderSizes[i] = http.CanonicalHeaderKey(header)
+		}
+		prometheusMiddleware.headerBytes = prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace:   opts.Namespace,
+				Subsystem:   opts.Subsystem,
+				Name:        headerBytesName,
+				Help:        "How large were the values of the tracked headers, partitioned by header.",
+				Buckets:     dflHeaderBuckets,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"header"},
+		)
+		prometheusMiddleware.register("headerBytes", prometheusMiddleware.headerBytes)
+	}
+
+	if opts.CountTruncatedResponses {
+		prometheusMiddleware.truncated = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        truncatedName,
+				Help:        "How many HTTP responses failed to be written after their status, partitioned by HTTP path.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path"},
+		)
+		prometheusMiddleware.register("truncated", prometheusMiddleware.truncated)
+	}
+
+	if opts.MaxLatencyClamp > 0 && opts.CountClampedLatencies {
+		prometheusMiddleware.clamped = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        clampedName,
+				Help:        "How many HTTP request durations were capped by the latency clamp, partitioned by HTTP path.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path"},
+		)
+		prometheusMiddleware.register("clamped", prometheusMiddleware.clamped)
+	}
+
+	if opts.RecoverPanics {
+		prometheusMiddleware.panics = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        panicsName,
+				Help:        "How many panics of HTTP handlers were recovered, partitioned by HTTP path.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path"},
+		)
+		prometheusMiddleware.register("panics", prometheusMiddleware.panics)
+	}
+
+	if opts.RateLimitRemainingHeader != "" {
+		prometheusMiddleware.rateLimit = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   opts.Namespace,
+				Name:        rateLimitName,
+				Help:        "The rate limit quota left as of the latest response, partitioned by HTTP path.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path"},
+		)
+		prometheusMiddleware.register("rateLimit", prometheusMiddleware.rateLimit)
+	}
+
+	if opts.ConcurrencyLimitHeader != "" {
+		if prometheusMiddleware.opts.ConcurrencyRejectedCode == 0 {
+			prometheusMiddleware.opts.ConcurrencyRejectedCode = http.StatusServiceUnavailable
+		}
+		prometheusMiddleware.rejected = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        rejectedName,
+				Help:        "How many HTTP requests were rejected by a concurrency limit, partitioned by HTTP path.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path"},
+		)
+		prometheusMiddleware.register("rejected", prometheusMiddleware.rejected)
+	}
+
+	if opts.CountCacheValidators {
+		prometheusMiddleware.validators = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        validatorName,
+				Help:        "How many HTTP responses carried a cache validator, partitioned by HTTP path and whether they did.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path", "cacheable"},
+		)
+		prometheusMiddleware.register("validators", prometheusMiddleware.validators)
+	}
+
+	if len(opts.RequiredHeaders) > 0 {
+		prometheusMiddleware.opts.RequiredHeaders = make([]string, len(opts.RequiredHeaders))
+		for i, header := range opts.RequiredHeaders {
+			prometheusMiddleware.opts.RequiredHeaders[i] = http.CanonicalHeaderKey(header)
+		}
+		prometheusMiddleware.missing = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        missingName,
+				Help:        "How many HTTP requests lacked a required header, partitioned by header and HTTP path.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"header", "path"},
+		)
+		prometheusMiddleware.register("missing", prometheusMiddleware.missing)
+	}
+
+	if opts.CountTLSVersions {
+		prometheusMiddleware.tlsVersion = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   opts.Namespace,
+				Name:        tlsVersionName,
+				Help:        "How many HTTP requests processed, partitioned by TLS version.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"tls_version"},
+		)
+		prometheusMiddleware.register("tlsVersion", prometheusMiddleware.tlsVersion)
+	}
+
+	if opts.CountTLSResumptions {
+		prometheusMiddleware.tlsResumed = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        tlsResumedName,
+			Help:        "How many HTTP requests were served over a resumed TLS session.",
+			Subsystem:   opts.Subsystem,
+			ConstLabels: opts.ConstLabels,
+		})
+		prometheusMiddleware.register("tlsResumed", prometheusMiddleware.tlsResumed)
+
+		prometheusMiddleware.tlsFull = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   opts.Namespace,
+			Name:        tlsFullName,
+			Help:        "How many HTTP requests were served over a TLS session established by a full handshake.",
+			Subsystem:   opts.Subsystem,
+			ConstLabels: opts.ConstLabels,
+		})
+		prometheusMiddleware.register("tlsFull", prometheusMiddleware.tlsFull)
+	}
+
+	if opts.RateWindow > 0 {
+		prometheusMiddleware.rate = newRateWindow(opts)
+		prometheusMiddleware.register("rate", prometheusMiddleware.rate.gauge)
+		go prometheusMiddleware.rate.run()
+	}
+
+	if opts.DistinctClientKeyFunc != nil {
+		prometheusMiddleware.clients = newDistinctCounter(opts)
+		prometheusMiddleware.register("clients", prometheusMiddleware.clients.gauge)
+	}
+
+	if opts.TrackOldestInFlight {
+		prometheusMiddleware.inflight = newInflightRequests(opts)
+		prometheusMiddleware.register("inflight", prometheusMiddleware.inflight.gauge)
+	}
+
+	if opts.TrackInFlightByPath {
+		prometheusMiddleware.concurrent = prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   opts.Namespace,
+				Name:        inflightName,
+				Help:        "How many HTTP requests are being served, partitioned by HTTP path and method.",
+				Subsystem:   opts.Subsystem,
+				ConstLabels: opts.ConstLabels,
+			},
+			[]string{"path", "method"},
+		)
+		prometheusMiddleware.register("concurrent", prometheusMiddleware.concurrent)
+	}
+
+	if prometheusMiddleware.self != nil {
+		prometheusMiddleware.register("self", prometheusMiddleware.self)
+	}
+
+	if opts.AsyncBufferSize > 0 {
+		prometheusMiddleware.async = newAsyncRecorder(opts)
+		prometheusMiddleware.async.self = prometheusMiddleware.self
+		prometheusMiddleware.register("dropped", prometheusMiddleware.async.dropped)
+		go prometheusMiddleware.async.run(prometheusMiddleware.record)
+	}
+
+	if opts.SlowRequestLogger != nil {
+		prometheusMiddleware.slow = newSlowLogger(opts.SlowRequestLogger, slowLogBufferSize)
+		prometheusMiddleware.slow.self = prometheusMiddleware.self
+		go prometheusMiddleware.slow.run()
 	}
 
 	return &prometheusMiddleware
 }
 
+// namedCollector is a collector of the middleware along with the name used in logs.
+type namedCollector struct {
+	name string
+	prometheus.Collector
+}
+
+// register adds the collector to the middleware and registers it, unless
+// registration is deferred until the first request by Opts.LazyRegister.
+func (p *PrometheusMiddleware) register(name string, collector prometheus.Collector) {
+	c := namedCollector{name: name, Collector: collector}
+	p.collectors = append(p.collectors, c)
+
+	if !p.opts.LazyRegister {
+		p.registerCollector(c)
+	}
+}
+
+// registerCollector registers the collector into every configured registerer. A failure is
+// logged and does not prevent the registration into the remaining registerers.
+func (p *PrometheusMiddleware) registerCollector(c namedCollector) {
+	for _, registerer := range p.opts.Registerers {
+		if err := registerer.Register(c.Collector); err != nil {
+			p.self.registrationError()
+			p.opts.logger().Println("prometheusMiddleware."+c.name+" was not registered:", err)
+		}
+	}
+}
+
+// registerLazily registers every collector on the first call when Opts.LazyRegister is set.
+// Concurrent callers block until the registration is done.
+func (p *PrometheusMiddleware) registerLazily() {
+	p.lazyOnce.Do(func() {
+		for _, c := range p.collectors {
+			p.registerCollector(c)
+		}
+	})
+}
+
+// hasLabels reports whether the collector provided by the named option has exactly the label names,
+// logging the mismatch otherwise. The series created to check it is deleted right away.
+func (p *PrometheusMiddleware) hasLabels(option string, vec *prometheus.MetricVec, names []string) bool {
+	labels := make(prometheus.Labels, len(names))
+	for _, name := range names {
+		labels[name] = ""
+	}
+
+	if _, err := vec.GetMetricWith(labels); err != nil {
+		p.opts.logger().Println("prometheusMiddleware "+option+" was not used:", err)
+		return false
+	}
+	vec.Delete(labels)
+	return true
+}
+
+// hostname returns the hostname of the machine, replaced in tests.
+var hostname = os.Hostname
+
+// withHostnameLabel returns a copy of the constant labels with the "instance" label set to
+// the hostname, unless already set or the hostname is unknown.
+func withHostnameLabel(opts Opts) prometheus.Labels {
+	if _, ok := opts.ConstLabels["instance"]; ok {
+		return opts.ConstLabels
+	}
+	host, err := hostname()
+	if err != nil {
+		opts.logger().Println("prometheusMiddleware instance label was not added:", err)
+		return opts.ConstLabels
+	}
+
+	return withConstLabel(opts.ConstLabels, "instance", host)
+}
+
+// withConstLabel returns a copy of the constant labels with the label added, unless already set.
+func withConstLabel(constLabels prometheus.Labels, name, value string) prometheus.Labels {
+	if _, ok := constLabels[name]; ok {
+		return constLabels
+	}
+
+	labels := prometheus.Labels{name: value}
+	for name, value := range constLabels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// overrunBuckets returns the buckets with a first bucket of 0, counting the requests which
+// overran their deadline.
+func overrunBuckets(buckets []float64) []float64 {
+	if len(buckets) > 0 && buckets[0] <= 0 {
+		return buckets
+	}
+	return append([]float64{0}, buckets...)
+}
+
+// SizeObserver configures how request or response sizes are observed.
+type SizeObserver struct {
+	// Summary observes the sizes in a summary instead of a histogram.
+	Summary bool
+	// Buckets are the buckets of the histogram. Defaults to 100B, 1kB, 5kB, 20kB and 50kB.
+	Buckets []float64
+	// Objectives are the quantile objectives of the summary. Defaults to the median,
+	// 90th and 99th percentiles.
+	Objectives map[float64]float64
+}
+
+// sizeObserver returns the configuration of a size collector, observer when set or else
+// the one of Opts.SizeAsSummary and Opts.SizeObjectives.
+func sizeObserver(opts Opts, observer *SizeObserver) SizeObserver {
+	if observer != nil {
+		return *observer
+	}
+	return SizeObserver{Summary: opts.SizeAsSummary, Objectives: opts.SizeObjectives}
+}
+
+// newSizeVec creates the collector used to observe request or response sizes,
+// a histogram or a summary according to observer, named under subsystem.
+func newSizeVec(opts Opts, subsystem string, observer SizeObserver, name, help string, labels []string) prometheus.ObserverVec {
+	if observer.Summary {
+		objectives := observer.Objectives
+		if len(objectives) == 0 {
+			objectives = dflSizeObjectives
+		}
+
+		return prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace:   opts.Namespace,
+				Subsystem:   subsystem,
+				Name:        name,
+				Help:        help,
+				Objectives:  objectives,
+				ConstLabels: opts.ConstLabels,
+			},
+			labels,
+		)
+	}
+
+	buckets := observer.Buckets
+	if len(buckets) == 0 {
+		buckets = dflSizeBuckets
+	}
+
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   opts.Namespace,
+			Subsystem:   subsystem,
+			Name:        name,
+			Help:        help,
+			Buckets:     buckets,
+			ConstLabels: opts.ConstLabels,
+		},
+		labels,
+	)
+}
+
 // InstrumentHandlerDuration is a middleware that wraps the http.Handler and it record
 // how long the handler took to run, which path was called, and the status code.
 // This method is going to be used with gorilla/mux.
 func (p *PrometheusMiddleware) InstrumentHandlerDuration(next http.Handler) http.Handler {
+	return p.instrument(next, instrumentation{expectRoute: true})
+}
+
+// instrumentation tells instrument where the path label comes from.
+type instrumentation struct {
+	// captureRoutes takes the path label from the route captured by captureRoute once the
+	// handler returns, or from the unmatched labels for 404 and 405 responses without route.
+	captureRoutes bool
+	// path is the path label of every request when set.
+	path string
+	// router resolves the route of the 405 responses with Opts.ResolveMethodNotAllowedRoutes.
+	router *mux.Router
+	// expectRoute warns once when a request is served by no gorilla/mux route, which tells that
+	// InstrumentHandlerDuration is used outside of a router.
+	expectRoute bool
+}
+
+// instrument wraps next, recording its requests.
+func (p *PrometheusMiddleware) instrument(next http.Handler, in instrumentation) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		begin := time.Now()
+		p.serve(w, r, next, in)
+	})
+}
+
+// serve serves the request with next and records it as in describes. Adapters calling the next
+// handler themselves call it directly, without building a handler per request.
+func (p *PrometheusMiddleware) serve(w http.ResponseWriter, r *http.Request, next http.Handler, in instrumentation) {
+	delay := time.Duration(-1)
+	if p.delay != nil {
+		delay = schedulingDelay(r.Context(), p.opts.Now())
+	}
+
+	preflight := isPreflight(r)
+	if preflight && p.opts.SkipPreflight {
+		next.ServeHTTP(w, r)
+		return
+	}
+	collapsed := preflight && p.opts.CollapsePreflight
+
+	path := in.path
+	if collapsed {
+		path = preflightPath
+	} else if path == "" {
+		path = p.resolvePath(r)
+	}
+	// The route served by a wrapped router is only known once it returns, and so is the
+	// pattern of a wrapped net/http.ServeMux when no router matched the request yet.
+	deferred := in.path == "" && !collapsed && MuxRouteTemplate(r) == "" && requestPattern(r) == ""
+	allowed := in.captureRoutes || deferred || p.routes.allowed(path, MuxRouteTemplate(r), MuxRouteName(r))
+	if !allowed || p.isMetricsPath(r, path) || p.ignore != nil && p.ignore.ignored(r, path) {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	if p.opts.LazyRegister {
+		p.registerLazily()
+	}
+	begin := p.opts.Now()
+	pattern := requestPattern(r)
+	if p.inflight != nil {
+		defer p.inflight.remove(p.inflight.add(begin))
+	}
+
+	var route *capturedRoute
+	if in.captureRoutes && !collapsed {
+		route = &capturedRoute{}
+		r = r.WithContext(context.WithValue(r.Context(), capturedRouteKey{}, route))
+	}
+	if p.concurrent != nil && route == nil {
+		if deferred && p.opts.PathLabelFunc == nil && len(p.opts.PathLabelSources) == 0 {
+			// path comes from the raw URL: tracking it would add a series per user or ID.
+			defer p.trackInFlight(r, pendingPath)()
+		} else {
+			defer p.trackInFlight(r, path)()
+		}
+	}
+
+	var phases *PhaseTimer
+	if p.phase != nil {
+		phases = &PhaseTimer{now: p.opts.Now, durations: make(map[string]time.Duration)}
+		r = r.WithContext(context.WithValue(r.Context(), phaseTimerKey{}, phases))
+	}
+
+	var inflated *DecompressedSize
+	if p.inflated != nil {
+		inflated = &DecompressedSize{}
+		r = r.WithContext(context.WithValue(r.Context(), decompressedSizeKey{}, inflated))
+	}
 
-		delegate := &responseWriterDelegator{ResponseWriter: w}
-		rw := delegate
+	var body *countingReadCloser
+	if p.opts.AccurateMultipartSize && r.Body != nil && isMultipart(r) {
+		body = &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	var timed *timedReadCloser
+	if p.bodyRead != nil && r.Body != nil && r.Body != http.NoBody {
+		timed = &timedReadCloser{ReadCloser: r.Body, now: p.opts.Now}
+		r.Body = timed
+	}
 
+	delegate := p.newDelegator(w)
+	defer p.releaseDelegator(delegate)
+	delegate.measureHeader = p.reqHeaderSize != nil
+	delegate.tailSize = p.opts.ResponseTailSize
+	if p.ttfb != nil || p.headers != nil {
+		delegate.now = p.opts.Now
+	}
+	var rw http.ResponseWriter = delegate
+	var recorder ResponseRecorder
+	if p.opts.WrapResponseWriter != nil {
+		recorder = p.opts.WrapResponseWriter(w)
+		delegate.ResponseWriter = recorder
+		rw = recorder
+	}
+
+	panicked := false
+	if p.panics != nil {
+		panicked = p.serveRecovering(next, rw, r, delegate, recorder)
+	} else {
 		next.ServeHTTP(rw, r) // call original
+	}
+
+	if p.opts.MeasureUntilFlushed && delegate.flushed && !delegate.hijacked {
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	elapsed := p.opts.Now().Sub(begin)
+	if recorder != nil {
+		delegate.recordedBy(recorder)
+	}
+	if panicked {
+		// The request failed whatever status was sent before the panic.
+		delegate.status, delegate.wroteHeader = http.StatusInternalServerError, true
+	}
+
+	if route != nil {
+		if route.captured {
+			path = route.path
+		} else if unmatched := p.unmatchedPath(delegate.Status()); unmatched != "" {
+			path = unmatched
+		}
+		if !p.routes.allowed(path, route.name) || p.ignore != nil && p.ignore.ignored(r, path) {
+			return
+		}
+	} else if in.path == "" && !collapsed && requestPattern(r) != pattern {
+		// A net/http.ServeMux served by next matched the request in place.
+		path = p.resolvePath(r)
+		if !p.routes.allowed(path, StdlibPatternPath(r)) || p.ignore != nil && p.ignore.ignored(r, path) {
+			return
+		}
+	} else if deferred && !p.routes.allowed(path) {
+		return
+	}
+	if in.expectRoute {
+		p.warnUnrouted(r)
+	}
+	if p.opts.ResolveMethodNotAllowedRoutes && in.router != nil && !collapsed && (route == nil || !route.captured) &&
+		delegate.Status() == http.StatusMethodNotAllowed {
+		if template := methodMismatchTemplate(in.router, r); template != "" {
+			path = p.labelPath(template)
+			if !p.routes.allowed(path, template) || p.ignore != nil && p.ignore.ignored(r, path) {
+				return
+			}
+		}
+	}
+
+	warmup := p.warmingUp(begin.Add(elapsed))
+	if warmup && !p.opts.LabelWarmup {
+		return
+	}
+
+	if p.paths != nil {
+		if path = p.paths.limit(path); path == overflowPath {
+			p.self.overflow()
+		}
+	}
+
+	o := &observation{
+		labels:    p.labels(r, delegate, path, elapsed),
+		status:    p.status(delegate),
+		truncated: delegate.writeFailed,
+		panicked:  panicked,
+		path:      path,
+		elapsed:   elapsed,
+		ttfb:      elapsed,
+		bodyRead:  -1,
+		delay:     delay,
+		reqSize:   requestSize(r, body, &p.opts),
+		resSize:   delegate.written,
+		streaming: p.opts.SkipStreamingResponses && isStreaming(delegate.Header()),
+	}
+
+	if p.opts.LabelWarmup {
+		o.labels["warmup"] = strconv.FormatBool(warmup)
+	}
+	if !delegate.firstWrite.IsZero() {
+		o.ttfb = delegate.firstWrite.Sub(begin)
+	}
+	o.headers = o.ttfb
+	if !delegate.headerWritten.IsZero() {
+		o.headers = delegate.headerWritten.Sub(begin)
+	}
+	if inflated != nil {
+		o.inflated, o.hasInflated = inflated.value()
+	}
+	if timed != nil && !timed.first.IsZero() {
+		o.bodyRead = timed.last.Sub(timed.first)
+	}
+	if p.slack != nil {
+		if deadline, ok := r.Context().Deadline(); ok {
+			o.slack, o.hasSlack = deadline.Sub(begin.Add(elapsed)), true
+		}
+	}
+	if p.opts.ExemplarLabels != nil && elapsed > p.opts.ExemplarThreshold && p.sampled(r) && p.exemplarSampled() {
+		o.exemplar = p.opts.ExemplarLabels(r.Context())
+	}
+
+	if p.reqHeaderSize != nil {
+		if !delegate.wroteHeader {
+			delegate.headerSize = headerSize(delegate.Header())
+		}
+		o.reqHeaderSize = headerSize(r.Header)
+		o.resHeaderSize = delegate.headerSize
+	}
+
+	if p.headerBytes != nil {
+		o.headerSizes = trackedHeaderSizes(p.opts.TrackHeaderSizes, r.Header, delegate.Header())
+	}
 
-		route := mux.CurrentRoute(r)
-		path, _ := route.GetPathTemplate()
-
-		code := sanitizeCode(delegate.status)
-		method := sanitizeMethod(r.Method)
-
-		p.request.WithLabelValues(
-			code,
-			method,
-			path,
-		).Inc()
-
-		p.latency.WithLabelValues(
-			code,
-			method,
-			path,
-		).Observe(float64(time.Since(begin)) / float64(time.Second))
-
-		p.reqSize.WithLabelValues(
-			code,
-			method,
-			path,
-		).Observe(float64(computeApproximateRequestSize(r)))
-
-		p.resSize.WithLabelValues(
-			code,
-			method,
-			path,
-		).Observe(float64(delegate.written))
+	if p.rateLimit != nil {
+		o.rateLimit, o.hasRateLimit = rateLimitRemaining(delegate.Header(), p.opts.RateLimitRemainingHeader)
+	}
+
+	if p.clients != nil {
+		o.client = p.opts.DistinctClientKeyFunc(r)
+	}
+
+	if phases != nil {
+		o.phases = phases.snapshot()
+	}
+
+	o.rejected = p.rejected != nil && delegate.Status() == p.opts.ConcurrencyRejectedCode && delegate.Header().Get(p.opts.ConcurrencyLimitHeader) != ""
+
+	if p.validators != nil {
+		o.cacheable = cacheValidator(delegate.Header())
+	}
+
+	if p.missing != nil {
+		for _, header := range p.opts.RequiredHeaders {
+			if _, ok := r.Header[header]; !ok {
+				o.missing = append(o.missing, header)
+			}
+		}
+	}
+
+	if p.tlsResumed != nil && r.TLS != nil {
+		o.tls, o.tlsResumed = true, r.TLS.DidResume
+	}
+	if p.tlsVersion != nil {
+		o.tlsVersion = tlsVersion(r)
+	}
+
+	if p.async == nil || !p.async.send(o) {
+		p.record(o)
+	}
+
+	if p.slow != nil && elapsed > p.opts.SlowRequestThreshold {
+		p.slow.log(p.slowRequestLine(r, o))
+	}
+
+	if p.opts.Annotate != nil {
+		p.opts.Annotate(r, RequestInfo{
+			Path:         path,
+			Code:         p.status(delegate),
+			Duration:     elapsed,
+			RequestSize:  o.reqSize,
+			ResponseSize: delegate.written,
+		})
+	}
+}
+
+// trackInFlight counts the request in the in-flight gauge of its path and method, and returns the
+// function removing it, to be deferred so that it runs even when the handler panics.
+func (p *PrometheusMiddleware) trackInFlight(r *http.Request, path string) func() {
+	if p.paths != nil && path != pendingPath {
+		path = p.paths.limit(path)
+	}
+	gauge := p.concurrent.WithLabelValues(path, sanitizeMethod(r.Method))
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// isMetricsPath reports whether the request, whose path label is path, is a scrape of Opts.MetricsPath.
+func (p *PrometheusMiddleware) isMetricsPath(r *http.Request, path string) bool {
+	return p.opts.MetricsPath != "" && (path == p.opts.MetricsPath || r.URL.Path == p.opts.MetricsPath)
+}
+
+// sampled reports whether the request may get an exemplar according to Opts.RecordOnlyIfSampled.
+func (p *PrometheusMiddleware) sampled(r *http.Request) bool {
+	if !p.opts.RecordOnlyIfSampled {
+		return true
+	}
+	return p.opts.IsSampled != nil && p.opts.IsSampled(r.Context())
+}
+
+// warnUnrouted logs once that InstrumentHandlerDuration served a request outside of a gorilla/mux
+// router, e.g. as the top handler of the server, unless another source of path labels is configured.
+func (p *PrometheusMiddleware) warnUnrouted(r *http.Request) {
+	if p.opts.PathLabelFunc != nil || len(p.opts.PathLabelSources) > 0 || p.opts.AutoTemplatePatterns != nil || p.opts.DisableAutoTemplate {
+		return
+	}
+	if mux.CurrentRoute(r) != nil || StdlibPatternPath(r) != "" {
+		return
+	}
+
+	p.unrouted.Do(func() {
+		p.opts.logger().Println("prometheusMiddleware served a request outside of a gorilla/mux router, " +
+			"labelled with its templated URL path: use router.Use(InstrumentHandlerDuration), " +
+			"wrap a net/http.ServeMux, or set PathLabelFunc")
 	})
 }
 
+// warmingUp reports whether a request completing at end is part of the Opts.WarmupDuration.
+func (p *PrometheusMiddleware) warmingUp(end time.Time) bool {
+	return p.opts.WarmupDuration > 0 && end.Sub(p.started) < p.opts.WarmupDuration
+}
+
+// exemplarSampled reports whether a slow request gets an exemplar according to Opts.ExemplarSampleRate.
+func (p *PrometheusMiddleware) exemplarSampled() bool {
+	rate := p.opts.ExemplarSampleRate
+	return rate <= 0 || rate >= 1 || p.random() < rate
+}
+
+// resolvePath returns the value of the path label for the request: the output of Opts.PathLabelSources
+// or Opts.PathLabelFunc, the template of its gorilla/mux route, the path of its net/http.ServeMux
+// pattern, or its templated URL path when it is served by neither.
+func (p *PrometheusMiddleware) resolvePath(r *http.Request) string {
+	var path string
+	if len(p.opts.PathLabelSources) > 0 {
+		path = sourcePath(p.opts.PathLabelSources, r)
+	} else if p.opts.PathLabelFunc != nil {
+		path = p.opts.PathLabelFunc(r)
+	} else if route := mux.CurrentRoute(r); route != nil {
+		path, _ = route.GetPathTemplate()
+	} else if pattern := StdlibPatternPath(r); pattern != "" {
+		path = pattern
+	} else {
+		path = p.templater.template(r.URL.Path)
+	}
+
+	return p.labelPath(path)
+}
+
+// labelPath returns the path label of a template or path, once stripped, lowercased, redacted
+// and checked against the allow-list as configured.
+func (p *PrometheusMiddleware) labelPath(path string) string {
+	path = stripPathPrefix(path, p.opts.PathPrefixStrip)
+	if p.opts.LowercasePath {
+		path = strings.ToLower(path)
+	}
+	if p.opts.PathRedactor != nil {
+		path = p.opts.PathRedactor(path)
+	}
+	if p.allowed != nil {
+		if _, ok := p.allowed[path]; !ok {
+			return redactedPath
+		}
+	}
+	return path
+}
+
+// stripPathPrefix removes prefix from path when it matches on a segment boundary,
+// making sure the result still starts with "/". Otherwise path is returned unchanged.
+func stripPathPrefix(path, prefix string) string {
+	if prefix == "" || !strings.HasPrefix(path, prefix) {
+		return path
+	}
+
+	stripped := path[len(prefix):]
+	if !strings.HasSuffix(prefix, "/") && stripped != "" && !strings.HasPrefix(stripped, "/") {
+		return path
+	}
+	if !strings.HasPrefix(stripped, "/") {
+		stripped = "/" + stripped
+	}
+	return stripped
+}
+
 type responseWriterDelegator struct {
 	http.ResponseWriter
 	status      int
 	written     int64
 	wroteHeader bool
+
+	measureHeader bool
+	headerSize    int
+
+	now           func() time.Time
+	firstWrite    time.Time
+	headerWritten time.Time
+
+	hijacked    bool
+	writeFailed bool
+	flushed     bool
+
+	tailSize int
+	tail     []byte
 }
 
 func (r *responseWriterDelegator) WriteHeader(code int) {
+	if r.now != nil && r.headerWritten.IsZero() {
+		r.headerWritten = r.now()
+	}
 	r.status = code
 	r.wroteHeader = true
+	if r.measureHeader {
+		r.headerSize = headerSize(r.ResponseWriter.Header())
+	}
 	r.ResponseWriter.WriteHeader(code)
 }
 
+// Flush implements http.Flusher, which streaming handlers like server-sent events rely on.
+// It is a no-op when the wrapped ResponseWriter does not support flushing.
+func (r *responseWriterDelegator) Flush() {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.flushed = true
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, which websockets rely on. It fails when the
+// wrapped ResponseWriter does not support hijacking.
+func (r *responseWriterDelegator) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("prometheusmiddleware: the ResponseWriter does not implement http.Hijacker")
+	}
+
+	r.hijacked = true
+	return hijacker.Hijack()
+}
+
 func (r *responseWriterDelegator) Write(b []byte) (int, error) {
+	if r.now != nil && r.firstWrite.IsZero() {
+		r.firstWrite = r.now()
+	}
 	if !r.wroteHeader {
+		// The implicit 200 is written by this first Write, so the status went out with it.
+		r.headerWritten = r.firstWrite
 		r.WriteHeader(http.StatusOK)
 	}
 	n, err := r.ResponseWriter.Write(b)
 	r.written += int64(n)
+	if err != nil {
+		r.writeFailed = true
+	}
+	if r.tailSize > 0 {
+		r.captureTail(b[:n])
+	}
 	return n, err
 }
 
+// status returns the status code of the response in the metrics, which is Opts.TruncatedStatus
+// for truncated responses when set.
+func (p *PrometheusMiddleware) status(delegate *responseWriterDelegator) int {
+	if delegate.writeFailed && p.opts.TruncatedStatus != 0 {
+		return p.opts.TruncatedStatus
+	}
+	return delegate.Status()
+}
+
+// codeLabel returns the code label of a status code.
+func (p *PrometheusMiddleware) codeLabel(status int) string {
+	if p.detailed != nil {
+		if _, ok := p.detailed[status]; !ok {
+			return "ok"
+		}
+	}
+	if p.opts.CodeLabelFunc != nil {
+		return p.opts.CodeLabelFunc(status)
+	}
+	return sanitizeCode(status)
+}
+
 func sanitizeMethod(m string) string {
 	return strings.ToLower(m)
 }
@@ -181,26 +1850,141 @@ func sanitizeCode(s int) string {
 	return strconv.Itoa(s)
 }
 
-func computeApproximateRequestSize(r *http.Request) int {
-	s := 0
-	if r.URL != nil {
-		s = len(r.URL.Path)
+// RequestSizeComponents selects the parts of a request which its size counts.
+type RequestSizeComponents uint8
+
+const (
+	// RequestSizeLine counts the method, URL path and protocol of the request line.
+	RequestSizeLine RequestSizeComponents = 1 << iota
+	// RequestSizeQuery counts the query string of the URL, without its "?".
+	RequestSizeQuery
+	// RequestSizeHeaders counts the names and values of the headers.
+	RequestSizeHeaders
+	// RequestSizeHost counts the Host header, kept apart from the other headers by net/http.
+	RequestSizeHost
+	// RequestSizeBody counts the Content-Length, or the bytes read from multipart bodies with
+	// Opts.AccurateMultipartSize.
+	RequestSizeBody
+
+	// DefaultRequestSizeComponents are the components counted when Opts.RequestSizeComponents is zero.
+	DefaultRequestSizeComponents = RequestSizeLine | RequestSizeHeaders | RequestSizeHost | RequestSizeBody
+)
+
+// requestSize returns the size of the request components selected by the options, adding the
+// bytes read from body when the Content-Length of the request is unknown, and the rest of the
+// request line with Opts.AccurateRequestLine. With Opts.CheapRequestSize, it is the Content-Length.
+func requestSize(r *http.Request, body *countingReadCloser, opts *Opts) int {
+	if opts.CheapRequestSize {
+		if r.ContentLength < 0 {
+			return 0
+		}
+		return int(r.ContentLength)
 	}
 
-	s += len(r.Method)
-	s += len(r.Proto)
-	for name, values := range r.Header {
-		s += len(name)
-		for _, value := range values {
-			s += len(value)
+	components := opts.RequestSizeComponents
+	if components == 0 {
+		components = DefaultRequestSizeComponents
+	}
+
+	s := computeRequestSize(r, components)
+	if components&RequestSizeBody != 0 && body != nil && r.ContentLength == -1 {
+		s += int(body.read)
+	}
+	if opts.AccurateRequestLine {
+		s += requestLineRemainder(r, components)
+	}
+	return s
+}
+
+// requestLineRemainder returns the size of the parts of the request line which
+// computeApproximateRequestSize leaves out: the query string, the spaces and the CRLF.
+// The query string is left out when the components already count it.
+func requestLineRemainder(r *http.Request, components RequestSizeComponents) int {
+	s := len("  \r\n")
+	if r.URL != nil && r.URL.RawQuery != "" {
+		s += len("?")
+		if components&RequestSizeQuery == 0 {
+			s += len(r.URL.RawQuery)
+		}
+	}
+	return s
+}
+
+func computeApproximateRequestSize(r *http.Request) int {
+	return computeRequestSize(r, DefaultRequestSizeComponents)
+}
+
+// computeRequestSize returns the size of the selected components of the request.
+func computeRequestSize(r *http.Request, components RequestSizeComponents) int {
+	s := 0
+	if components&RequestSizeLine != 0 {
+		if r.URL != nil {
+			s += len(r.URL.Path)
 		}
+		s += len(r.Method)
+		s += len(r.Proto)
+	}
+	if components&RequestSizeQuery != 0 && r.URL != nil {
+		s += len(r.URL.RawQuery)
+	}
+	if components&RequestSizeHeaders != 0 {
+		s += headerSize(r.Header)
+	}
+	if components&RequestSizeHost != 0 {
+		s += len(r.Host)
 	}
-	s += len(r.Host)
 
 	// N.B. r.Form and r.MultipartForm are assumed to be included in r.URL.
 
-	if r.ContentLength != -1 {
+	if components&RequestSizeBody != 0 && r.ContentLength != -1 {
 		s += int(r.ContentLength)
 	}
 	return s
 }
+
+// rateLimitRemaining parses the remaining quota of the response header, reporting false
+// when the header is absent or not a number.
+func rateLimitRemaining(h http.Header, name string) (float64, bool) {
+	value := h.Get(name)
+	if value == "" {
+		return 0, false
+	}
+
+	remaining, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(remaining) || math.IsInf(remaining, 0) {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// trackedHeaderSizes returns the size of the values of the headers, looked up in the request
+// header then in the response header, or -1 for those which are absent from both.
+func trackedHeaderSizes(headers []string, request, response http.Header) []int {
+	sizes := make([]int, len(headers))
+	for i, header := range headers {
+		values, ok := request[header]
+		if !ok {
+			values, ok = response[header]
+		}
+		if !ok {
+			sizes[i] = -1
+			continue
+		}
+		for _, value := range values {
+			sizes[i] += len(value)
+		}
+	}
+	return sizes
+}
+
+// headerSize returns the approximate size of the header, counting its names and values.
+func headerSize(h http.Header) int {
+	s := 0
+	for name, values := range h {
+		s += len(name)
+		for _, value := range values {
+			s += len(value)
+		}
+	}
+	return s
+}
@@ -1,14 +1,24 @@
 package prometheusmiddleware
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func Test_InstrumentGorillaMux(t *testing.T) {
@@ -53,3 +63,1674 @@ func Test_InstrumentGorillaMux(t *testing.T) {
 		t.Errorf("body does not contain request duration entry '%s'", responseSizeName)
 	}
 }
+
+func Test_resolvePath(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:     []prometheus.Registerer{prometheus.NewRegistry()},
+		PathPrefixStrip: "/api",
+		LowercasePath:   true,
+	})
+
+	var path string
+	r := mux.NewRouter()
+	r.HandleFunc("/api/Users/{ID}", func(w http.ResponseWriter, r *http.Request) {
+		path = middleware.resolvePath(r)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/Users/42", nil))
+
+	if path != "/users/{id}" {
+		t.Errorf("resolvePath() = %q, want %q", path, "/users/{id}")
+	}
+}
+
+func Test_resolvePathRedaction(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		PathRedactor: func(path string) string {
+			return strings.Replace(path, "/s3cr3t-hook", "/{hook}", 1)
+		},
+		PathAllowList: []string{"/users/{id}", "/internal/{hook}"},
+	})
+
+	paths := make(map[string]string)
+	r := mux.NewRouter()
+	for _, template := range []string{"/users/{id}", "/internal/s3cr3t-hook", "/debug/vars"} {
+		template := template
+		r.HandleFunc(template, func(w http.ResponseWriter, r *http.Request) {
+			paths[template] = middleware.resolvePath(r)
+		})
+	}
+
+	for _, url := range []string{"/users/42", "/internal/s3cr3t-hook", "/debug/vars"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	want := map[string]string{
+		"/users/{id}":           "/users/{id}",
+		"/internal/s3cr3t-hook": "/internal/{hook}",
+		"/debug/vars":           "redacted",
+	}
+	for template, path := range want {
+		if paths[template] != path {
+			t.Errorf("resolvePath() of %s = %q, want %q", template, paths[template], path)
+		}
+	}
+}
+
+func Test_stripPathPrefix(t *testing.T) {
+	tests := []struct {
+		path   string
+		prefix string
+		want   string
+	}{
+		{path: "/api/users/{id}", prefix: "", want: "/api/users/{id}"},
+		{path: "/api/users/{id}", prefix: "/api", want: "/users/{id}"},
+		{path: "/api/users/{id}", prefix: "/api/", want: "/users/{id}"},
+		{path: "/api", prefix: "/api", want: "/"},
+		{path: "/apiv2/users", prefix: "/api", want: "/apiv2/users"},
+		{path: "/other/users", prefix: "/api", want: "/other/users"},
+	}
+
+	for _, tt := range tests {
+		if got := stripPathPrefix(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("stripPathPrefix(%q, %q) = %q, want %q", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func Test_InstrumentWithCustomClock(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Now:         fakeClock(begin, begin.Add(250*time.Millisecond)),
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	histogram := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleCount() != 1 {
+		t.Errorf("latency sample count = %d, want 1", histogram.GetSampleCount())
+	}
+	if histogram.GetSampleSum() != 0.25 {
+		t.Errorf("latency sample sum = %v, want 0.25", histogram.GetSampleSum())
+	}
+}
+
+func Test_InstrumentMultipleRegistries(t *testing.T) {
+	registries := []*prometheus.Registry{prometheus.NewRegistry(), prometheus.NewRegistry()}
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{registries[0], registries[1]},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	for i, registry := range registries {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var found bool
+		for _, family := range families {
+			if family.GetName() == requestName {
+				found = family.GetMetric()[0].GetCounter().GetValue() == 1
+			}
+		}
+		if !found {
+			t.Errorf("registry %d does not contain a single request in '%s'", i, requestName)
+		}
+	}
+}
+
+func Test_InstrumentMultipartRequestSize(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:           []prometheus.Registerer{prometheus.NewRegistry()},
+		AccurateMultipartSize: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "upload.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(bytes.Repeat([]byte("x"), 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bodySize := body.Len()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.ContentLength = -1 // sent with chunked transfer encoding
+	wantSize := computeApproximateRequestSize(req) + bodySize
+
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	histogram := readMetric(t, middleware.reqSize.WithLabelValues("200", "post", "/upload").(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleSum() != float64(wantSize) {
+		t.Errorf("request size = %v, want %d", histogram.GetSampleSum(), wantSize)
+	}
+}
+
+func Test_InstrumentExemplarsForSlowRequests(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := []time.Time{
+		begin, begin.Add(100 * time.Millisecond),
+		begin, begin.Add(2 * time.Second),
+	}
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:       []prometheus.Registerer{prometheus.NewRegistry()},
+		Now:               fakeClock(clock...),
+		ExemplarThreshold: time.Second,
+		ExemplarLabels: func(ctx context.Context) prometheus.Labels {
+			return prometheus.Labels{"trace_id": "4bf92f3577b34da6"}
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	histogram := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	var exemplars []*dto.Exemplar
+	for _, bucket := range histogram.GetBucket() {
+		if bucket.GetExemplar() != nil {
+			exemplars = append(exemplars, bucket.GetExemplar())
+		}
+	}
+
+	if len(exemplars) != 1 {
+		t.Fatalf("got %d exemplars, want 1", len(exemplars))
+	}
+	if exemplars[0].GetValue() != 2 {
+		t.Errorf("exemplar value = %v, want 2", exemplars[0].GetValue())
+	}
+}
+
+func Test_InstrumentExemplarsOnlyIfSampled(t *testing.T) {
+	type sampledKey struct{}
+	now := time.Now()
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+		ExemplarLabels: func(ctx context.Context) prometheus.Labels {
+			return prometheus.Labels{"trace_id": "4bf92f3577b34da6"}
+		},
+		RecordOnlyIfSampled: true,
+		IsSampled: func(ctx context.Context) bool {
+			return ctx.Value(sampledKey{}) != nil
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	r.ServeHTTP(httptest.NewRecorder(), req.WithContext(context.WithValue(req.Context(), sampledKey{}, true)))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	histogram := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	exemplars := 0
+	for _, bucket := range histogram.GetBucket() {
+		if bucket.GetExemplar() != nil {
+			exemplars++
+		}
+	}
+	if exemplars != 1 {
+		t.Errorf("got %d exemplars, want 1 of the sampled request", exemplars)
+	}
+}
+
+func Test_InstrumentExemplarSampleRate(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := []time.Time{
+		begin, begin.Add(2 * time.Second),
+		begin, begin.Add(5 * time.Second),
+		begin, begin.Add(100 * time.Millisecond),
+	}
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:        []prometheus.Registerer{prometheus.NewRegistry()},
+		Now:                fakeClock(clock...),
+		ExemplarThreshold:  time.Second,
+		ExemplarSampleRate: 0.5,
+		ExemplarLabels: func(ctx context.Context) prometheus.Labels {
+			return prometheus.Labels{"trace_id": "4bf92f3577b34da6"}
+		},
+	})
+	draws := []float64{0.1, 0.9, 0.1}
+	middleware.random = func() float64 {
+		draw := draws[0]
+		draws = draws[1:]
+		return draw
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for i := 0; i < 3; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	histogram := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	var exemplars []*dto.Exemplar
+	for _, bucket := range histogram.GetBucket() {
+		if bucket.GetExemplar() != nil {
+			exemplars = append(exemplars, bucket.GetExemplar())
+		}
+	}
+
+	if len(exemplars) != 1 {
+		t.Fatalf("got %d exemplars, want 1", len(exemplars))
+	}
+	if exemplars[0].GetValue() != 2 {
+		t.Errorf("exemplar value = %v, want 2 of the slow sampled request", exemplars[0].GetValue())
+	}
+}
+
+func Test_InstrumentCodeLabelFunc(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		CodeLabelFunc: func(status int) string {
+			if status == http.StatusTooManyRequests {
+				return "rate_limited"
+			}
+			return "other"
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	counter := readMetric(t, middleware.request.WithLabelValues("rate_limited", "get", "/")).GetCounter()
+	if counter.GetValue() != 1 {
+		t.Errorf("request count = %v, want 1", counter.GetValue())
+	}
+}
+
+func Test_InstrumentHeaderBytes(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		TrackHeaderBytes: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(w, "ok")
+		w.Header().Set("X-Ignored", "headers set after writing are not sent")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "*/*")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	reqHistogram := readMetric(t, middleware.reqHeaderSize.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	if want := float64(len("Accept") + len("*/*")); reqHistogram.GetSampleSum() != want {
+		t.Errorf("request header size = %v, want %v", reqHistogram.GetSampleSum(), want)
+	}
+
+	resHistogram := readMetric(t, middleware.resHeaderSize.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	if want := float64(len("Content-Type") + len("text/plain")); resHistogram.GetSampleSum() != want {
+		t.Errorf("response header size = %v, want %v", resHistogram.GetSampleSum(), want)
+	}
+}
+
+func Test_InstrumentSkipStreamingResponses(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:            []prometheus.Registerer{prometheus.NewRegistry()},
+		SkipStreamingResponses: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/events", nil))
+
+	if !recorder.Flushed {
+		t.Error("response was not flushed")
+	}
+	if counter := readMetric(t, middleware.request.WithLabelValues("200", "get", "/events")).GetCounter(); counter.GetValue() != 1 {
+		t.Errorf("request count = %v, want 1", counter.GetValue())
+	}
+	histogram := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/events").(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleCount() != 0 {
+		t.Errorf("latency sample count = %d, want 0", histogram.GetSampleCount())
+	}
+}
+
+func Test_InstrumentConcurrencyRejected(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:            []prometheus.Registerer{prometheus.NewRegistry()},
+		ConcurrencyLimitHeader: "X-Concurrency-Limited",
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/limited", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Concurrency-Limited", "true")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	r.HandleFunc("/unavailable", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/limited", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/unavailable", nil))
+
+	if counter := readMetric(t, middleware.rejected.WithLabelValues("/limited")).GetCounter(); counter.GetValue() != 1 {
+		t.Errorf("rejected count of /limited = %v, want 1", counter.GetValue())
+	}
+	if counter := readMetric(t, middleware.rejected.WithLabelValues("/unavailable")).GetCounter(); counter.GetValue() != 0 {
+		t.Errorf("rejected count of /unavailable = %v, want 0", counter.GetValue())
+	}
+}
+
+func Test_InstrumentCacheValidators(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:          []prometheus.Registerer{prometheus.NewRegistry()},
+		CountCacheValidators: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/etag", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "body")
+	})
+	r.HandleFunc("/modified", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Wed, 01 Jan 2020 00:00:00 GMT")
+	})
+	r.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "body")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for _, target := range []string{"/etag", "/modified", "/plain", "/plain"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	tests := []struct {
+		path, cacheable string
+		want            float64
+	}{
+		{path: "/etag", cacheable: "has-validator", want: 1},
+		{path: "/modified", cacheable: "has-validator", want: 1},
+		{path: "/plain", cacheable: "has-validator", want: 0},
+		{path: "/plain", cacheable: "none", want: 2},
+	}
+	for _, tt := range tests {
+		counter := readMetric(t, middleware.validators.WithLabelValues(tt.path, tt.cacheable)).GetCounter()
+		if counter.GetValue() != tt.want {
+			t.Errorf("validator count of %s %s = %v, want %v", tt.path, tt.cacheable, counter.GetValue(), tt.want)
+		}
+	}
+}
+
+func Test_InstrumentPreflight(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Opts
+		want map[string]uint64
+	}{
+		{name: "default", want: map[string]uint64{"/users": 2}},
+		{name: "collapse", opts: Opts{CollapsePreflight: true}, want: map[string]uint64{"/users": 1, "preflight": 1}},
+		{name: "skip", opts: Opts{SkipPreflight: true, CollapsePreflight: true}, want: map[string]uint64{"/users": 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Registerers = []prometheus.Registerer{prometheus.NewRegistry()}
+			middleware := NewPrometheusMiddleware(tt.opts)
+
+			served := 0
+			r := mux.NewRouter()
+			r.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) { served++ })
+			r.Use(middleware.InstrumentHandlerDuration)
+
+			preflight := httptest.NewRequest("OPTIONS", "/users", nil)
+			preflight.Header.Set("Access-Control-Request-Method", "POST")
+			r.ServeHTTP(httptest.NewRecorder(), preflight)
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("OPTIONS", "/users", nil))
+
+			if served != 2 {
+				t.Errorf("served %d requests, want 2", served)
+			}
+			got := middleware.Snapshot().RequestsByPath
+			if len(got) != len(tt.want) || got["/users"] != tt.want["/users"] || got["preflight"] != tt.want["preflight"] {
+				t.Errorf("recorded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_InstrumentCircuitHeader(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:   []prometheus.Registerer{prometheus.NewRegistry()},
+		CircuitHeader: "X-Circuit",
+	})
+
+	open := true
+	breaker := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if open {
+				w.Header().Set("X-Circuit", "open")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	r.Use(middleware.InstrumentHandlerDuration, breaker)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil))
+	open = false
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders", nil))
+
+	for _, circuit := range []string{"open", "none"} {
+		counter := readMetric(t, middleware.request.WithLabelValues("503", "get", "/orders", circuit)).GetCounter()
+		if counter.GetValue() != 1 {
+			t.Errorf("request count with circuit %s = %v, want 1", circuit, counter.GetValue())
+		}
+	}
+}
+
+func Test_InstrumentWarmup(t *testing.T) {
+	tests := []struct {
+		name        string
+		labelWarmup bool
+		want        map[string]float64
+	}{
+		{name: "skip", want: map[string]float64{"": 2}},
+		{name: "label", labelWarmup: true, want: map[string]float64{"true": 2, "false": 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			middleware := NewPrometheusMiddleware(Opts{
+				Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+				Now: func() time.Time {
+					now = now.Add(time.Second)
+					return now
+				},
+				WarmupDuration: 5 * time.Second,
+				LabelWarmup:    tt.labelWarmup,
+			})
+
+			r := mux.NewRouter()
+			r.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {})
+			r.Use(middleware.InstrumentHandlerDuration)
+
+			// Each request takes a second and completes 2, 4, 6 and 8 seconds after the creation.
+			for i := 0; i < 4; i++ {
+				r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+			}
+
+			for warmup, want := range tt.want {
+				values := []string{"200", "get", "/users"}
+				if warmup != "" {
+					values = append(values, warmup)
+				}
+				if counter := readMetric(t, middleware.request.WithLabelValues(values...)).GetCounter(); counter.GetValue() != want {
+					t.Errorf("request count with warmup %q = %v, want %v", warmup, counter.GetValue(), want)
+				}
+			}
+		})
+	}
+}
+
+func Test_InstrumentCountBytes(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		CountBytes:       true,
+		CheapRequestSize: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "stored")
+	})
+	r.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("first body")))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("second")))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/missing", strings.NewReader("body")))
+
+	tests := []struct {
+		path              string
+		request, response float64
+	}{
+		{path: "/upload", request: 16, response: 12},
+		{path: "/missing", request: 4, response: 10},
+	}
+	for _, tt := range tests {
+		if counter := readMetric(t, middleware.reqBytes.WithLabelValues(tt.path)).GetCounter(); counter.GetValue() != tt.request {
+			t.Errorf("request bytes of %s = %v, want %v", tt.path, counter.GetValue(), tt.request)
+		}
+		if counter := readMetric(t, middleware.resBytes.WithLabelValues(tt.path)).GetCounter(); counter.GetValue() != tt.response {
+			t.Errorf("response bytes of %s = %v, want %v", tt.path, counter.GetValue(), tt.response)
+		}
+	}
+}
+
+func Test_InstrumentMaxLatencyClamp(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:           []prometheus.Registerer{prometheus.NewRegistry()},
+		Now:                   fakeClock(begin, begin.Add(2*time.Hour), begin, begin.Add(2*time.Second)),
+		MaxLatencyClamp:       time.Minute,
+		CountClampedLatencies: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/export", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/export", nil))
+
+	histogram := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/export").(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleCount() != 2 || histogram.GetSampleSum() != 62 {
+		t.Errorf("latency = %d observations summing to %v, want 2 summing to 62", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	if counter := readMetric(t, middleware.clamped.WithLabelValues("/export")).GetCounter(); counter.GetValue() != 1 {
+		t.Errorf("clamped count = %v, want 1", counter.GetValue())
+	}
+}
+
+func Test_InstrumentMaxLatencyClampPhases(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		// Every reading of the clock takes two hours.
+		Now: func() time.Time {
+			now = now.Add(2 * time.Hour)
+			return now
+		},
+		MaxLatencyClamp:       time.Minute,
+		TrackTimeToFirstByte:  true,
+		TrackTimeToHeaders:    true,
+		TrackBodyReadDuration: true,
+		Phases:                []string{"db"},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		PhaseTimerFromContext(r.Context()).Observe("db", 3*time.Hour)
+		_, _ = ioutil.ReadAll(r.Body)
+		fmt.Fprint(w, "export")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/export", strings.NewReader("query")))
+
+	for name, observer := range map[string]prometheus.Observer{
+		"time to first byte": middleware.ttfb.WithLabelValues("200", "post", "/export"),
+		"time to headers":    middleware.headers.WithLabelValues("200", "post", "/export"),
+		"body read":          middleware.bodyRead.WithLabelValues("200", "post", "/export"),
+		"db phase":           middleware.phase.WithLabelValues("/export", "db"),
+	} {
+		histogram := readMetric(t, observer.(prometheus.Metric)).GetHistogram()
+		if histogram.GetSampleCount() != 1 || histogram.GetSampleSum() != 60 {
+			t.Errorf("%s = %d observations summing to %v, want 1 clamped to 60", name, histogram.GetSampleCount(), histogram.GetSampleSum())
+		}
+	}
+}
+
+func Test_InstrumentTimeToFirstByte(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:          []prometheus.Registerer{prometheus.NewRegistry()},
+		Now:                  fakeClock(begin, begin.Add(100*time.Millisecond), begin.Add(3*time.Second)),
+		TrackTimeToFirstByte: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "first chunk")
+		fmt.Fprint(w, "slowly downloaded chunk")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download", nil))
+
+	ttfb := readMetric(t, middleware.ttfb.WithLabelValues("200", "get", "/download").(prometheus.Metric)).GetHistogram()
+	if ttfb.GetSampleSum() != 0.1 {
+		t.Errorf("time to first byte = %v, want 0.1", ttfb.GetSampleSum())
+	}
+	latency := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/download").(prometheus.Metric)).GetHistogram()
+	if latency.GetSampleSum() != 3 {
+		t.Errorf("latency = %v, want 3", latency.GetSampleSum())
+	}
+}
+
+func Test_InstrumentRequiredHeaders(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:     []prometheus.Registerer{prometheus.NewRegistry()},
+		RequiredHeaders: []string{"x-request-id", "X-Client-Version"},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Client-Version", "1.2.3")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if counter := readMetric(t, middleware.missing.WithLabelValues("X-Request-Id", "/")).GetCounter(); counter.GetValue() != 1 {
+		t.Errorf("missing X-Request-Id count = %v, want 1", counter.GetValue())
+	}
+	if counter := readMetric(t, middleware.missing.WithLabelValues("X-Client-Version", "/")).GetCounter(); counter.GetValue() != 0 {
+		t.Errorf("missing X-Client-Version count = %v, want 0", counter.GetValue())
+	}
+}
+
+func Test_InstrumentOperationLabel(t *testing.T) {
+	operations := map[string]bool{"GetUser": true, "ListOrders": true}
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		OperationLabelFunc: func(r *http.Request) string {
+			if operation := r.Header.Get("X-GraphQL-Operation"); operations[operation] {
+				return operation
+			}
+			return "other"
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for _, operation := range []string{"GetUser", "GetUser", "Introspection"} {
+		req := httptest.NewRequest("POST", "/graphql", nil)
+		req.Header.Set("X-GraphQL-Operation", operation)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for operation, want := range map[string]float64{"GetUser": 2, "other": 1} {
+		labels := prometheus.Labels{"code": "200", "method": "post", "path": "/graphql", "operation": operation}
+		if got := readMetric(t, middleware.request.With(labels)).GetCounter().GetValue(); got != want {
+			t.Errorf("%s requests = %v, want %v", operation, got, want)
+		}
+		if got := readMetric(t, middleware.latency.With(labels).(prometheus.Metric)).GetHistogram().GetSampleCount(); got != uint64(want) {
+			t.Errorf("%s latency samples = %v, want %v", operation, got, want)
+		}
+	}
+}
+
+func Test_InstrumentOptionalLabels(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:           []prometheus.Registerer{prometheus.NewRegistry()},
+		HandlerNameFunc:       func(r *http.Request) string { return "users" },
+		CacheStatusHeader:     "X-Cache",
+		RegionClassifier:      func(ip net.IP) string { return "europe" },
+		Regions:               []string{"europe"},
+		SlowRequestThreshold:  time.Hour,
+		LabelSlowRequests:     true,
+		LabelResponseEncoding: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "hit")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	counter := readMetric(t, middleware.request.With(prometheus.Labels{
+		"region":  "europe",
+		"cache":   "HIT",
+		"handler": "users",
+		"path":    "/users",
+		"method":  "get",
+		"code":    "200",
+	})).GetCounter()
+	if counter.GetValue() != 1 {
+		t.Errorf("request count = %v, want 1", counter.GetValue())
+	}
+
+	histogram := readMetric(t, middleware.latency.With(prometheus.Labels{
+		"slow":    "false",
+		"handler": "users",
+		"path":    "/users",
+		"method":  "get",
+		"code":    "200",
+	}).(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleCount() != 1 {
+		t.Errorf("latency sample count = %d, want 1", histogram.GetSampleCount())
+	}
+
+	histogram = readMetric(t, middleware.resSize.With(prometheus.Labels{
+		"encoding": "gzip",
+		"path":     "/users",
+		"method":   "get",
+		"code":     "200",
+	}).(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleCount() != 1 {
+		t.Errorf("response size sample count = %d, want 1", histogram.GetSampleCount())
+	}
+}
+
+func Test_InstrumentLabelSlowRequests(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Now: fakeClock(
+			begin, begin.Add(100*time.Millisecond),
+			begin, begin.Add(2*time.Second),
+		),
+		SlowRequestThreshold: time.Second,
+		LabelSlowRequests:    true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	for _, slow := range []string{"false", "true"} {
+		histogram := readMetric(t, middleware.latency.With(prometheus.Labels{
+			"slow":   slow,
+			"path":   "/users",
+			"method": "get",
+			"code":   "200",
+		}).(prometheus.Metric)).GetHistogram()
+		if histogram.GetSampleCount() != 1 {
+			t.Errorf("slow=%q latency sample count = %d, want 1", slow, histogram.GetSampleCount())
+		}
+	}
+}
+
+func Test_InstrumentSubsystem(t *testing.T) {
+	for _, summary := range []bool{false, true} {
+		middleware := NewPrometheusMiddleware(Opts{
+			Registerers:                  []prometheus.Registerer{prometheus.NewRegistry()},
+			Namespace:                    "shop",
+			Subsystem:                    "api",
+			TrackSizeRatio:               true,
+			TrackHeaderBytes:             true,
+			TrackHeaderSizes:             []string{"Cookie"},
+			TrackDecompressedRequestSize: true,
+			SizeAsSummary:                summary,
+		})
+
+		for name, collector := range map[string]prometheus.Collector{
+			sizeRatioName:          middleware.sizeRatio,
+			requestHeaderSizeName:  middleware.reqHeaderSize,
+			responseHeaderSizeName: middleware.resHeaderSize,
+			headerBytesName:        middleware.headerBytes,
+			decompressedSizeName:   middleware.inflated,
+		} {
+			descs := make(chan *prometheus.Desc, 1)
+			collector.Describe(descs)
+			if desc, want := (<-descs).String(), `fqName: "shop_api_`+name+`"`; !strings.Contains(desc, want) {
+				t.Errorf("%s (summary sizes: %v) is described as %s, want %s", name, summary, desc, want)
+			}
+		}
+	}
+}
+
+func Test_InstrumentSizeRatio(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:    []prometheus.Registerer{prometheus.NewRegistry()},
+		TrackSizeRatio: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("x", 1000))
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	histogram := readMetric(t, middleware.sizeRatio.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	if want := 1000 / float64(computeApproximateRequestSize(req)); histogram.GetSampleSum() != want {
+		t.Errorf("size ratio = %v, want %v", histogram.GetSampleSum(), want)
+	}
+}
+
+func Test_InstrumentLazyRegister(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:  []prometheus.Registerer{registry},
+		LazyRegister: true,
+		MetricsPath:  "/metrics",
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	// Scrapes are not instrumented, so they do not register the collectors.
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	if registry.Unregister(middleware.request) {
+		t.Error("request counter was registered by a scrape")
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 0 {
+		t.Errorf("got %d metric families before the first request, want 0", len(families))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+	wg.Wait()
+
+	if err := registry.Register(middleware.request); err == nil {
+		t.Error("request counter was not registered on the first request")
+	}
+	if counter := readMetric(t, middleware.request.WithLabelValues("200", "get", "/")).GetCounter(); counter.GetValue() != 10 {
+		t.Errorf("request count = %v, want 10", counter.GetValue())
+	}
+}
+
+func Test_InstrumentFineLatency(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:        []prometheus.Registerer{prometheus.NewRegistry()},
+		FineLatencyBuckets: []float64{0.001, 0.002, 0.005, 0.01},
+		FineLatencyRoutes:  []string{"/checkout"},
+	})
+
+	r := mux.NewRouter()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	r.HandleFunc("/checkout", handler)
+	r.HandleFunc("/about", handler)
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/checkout", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/about", nil))
+
+	for path, want := range map[string]uint64{"/checkout": 1, "/about": 0} {
+		histogram := readMetric(t, middleware.fine.WithLabelValues("200", "get", path).(prometheus.Metric)).GetHistogram()
+		if histogram.GetSampleCount() != want {
+			t.Errorf("fine latency sample count of %s = %d, want %d", path, histogram.GetSampleCount(), want)
+		}
+		if len(histogram.GetBucket()) != 4 {
+			t.Errorf("fine latency has %d buckets, want 4", len(histogram.GetBucket()))
+		}
+	}
+}
+
+func Test_InstrumentPhases(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Phases:      []string{"db", "render"},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		timer := PhaseTimerFromContext(r.Context())
+		timer.Observe("db", 200*time.Millisecond)
+		timer.Observe("db", 100*time.Millisecond)
+		timer.Observe("unknown", time.Second)
+		stop := timer.Start("render")
+		stop()
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	db := readMetric(t, middleware.phase.WithLabelValues("/", "db").(prometheus.Metric)).GetHistogram()
+	if db.GetSampleCount() != 1 || db.GetSampleSum() != 0.3 {
+		t.Errorf("db phase = %d samples summing to %v, want 1 sample of 0.3", db.GetSampleCount(), db.GetSampleSum())
+	}
+	render := readMetric(t, middleware.phase.WithLabelValues("/", "render").(prometheus.Metric)).GetHistogram()
+	if render.GetSampleCount() != 1 {
+		t.Errorf("render phase = %d samples, want 1", render.GetSampleCount())
+	}
+	if PhaseTimerFromContext(context.Background()).Start("db") == nil {
+		t.Error("nil PhaseTimer returned a nil stop function")
+	}
+}
+
+func Test_InstrumentBodyReadDuration(t *testing.T) {
+	// Every reading of the clock takes a second.
+	now := time.Now()
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:           []prometheus.Registerer{prometheus.NewRegistry()},
+		TrackBodyReadDuration: true,
+		Now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		// Reads the body, then EOF.
+		_, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	})
+	r.HandleFunc("/ignore", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("ab")))
+
+	histogram := readMetric(t, middleware.bodyRead.WithLabelValues("200", "post", "/upload").(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleCount() != 1 || histogram.GetSampleSum() != 2 {
+		t.Errorf("body read = %d samples summing to %v, want 1 sample of 2", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/ignore", strings.NewReader("ab")))
+
+	histogram = readMetric(t, middleware.bodyRead.WithLabelValues("200", "post", "/ignore").(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleCount() != 0 {
+		t.Errorf("unread body = %d samples, want 0", histogram.GetSampleCount())
+	}
+}
+
+func Test_InstrumentLatencyByOutcome(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		LatencyByOutcome: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{code}", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(mux.Vars(r)["code"])
+		w.WriteHeader(code)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for _, code := range []string{"200", "204", "302", "404", "429", "500", "503"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+code, nil))
+	}
+
+	for outcome, want := range map[string]uint64{"success": 3, "client_error": 2, "server_error": 2} {
+		histogram := readMetric(t, middleware.outcome.WithLabelValues(outcome, "/{code}").(prometheus.Metric)).GetHistogram()
+		if histogram.GetSampleCount() != want {
+			t.Errorf("%s requests = %d, want %d", outcome, histogram.GetSampleCount(), want)
+		}
+	}
+}
+
+func Test_requestSizeComponents(t *testing.T) {
+	req := httptest.NewRequest("POST", "/search?q=go", strings.NewReader("body"))
+	req.Header = http.Header{"Accept": {"*/*"}}
+
+	tests := []struct {
+		components RequestSizeComponents
+		want       int
+	}{
+		{components: RequestSizeLine, want: len("POST") + len("/search") + len("HTTP/1.1")},
+		{components: RequestSizeQuery, want: len("q=go")},
+		{components: RequestSizeHeaders, want: len("Accept") + len("*/*")},
+		{components: RequestSizeHost, want: len("example.com")},
+		{components: RequestSizeBody, want: len("body")},
+		{components: 0, want: computeApproximateRequestSize(req)},
+	}
+
+	for _, tt := range tests {
+		if got := requestSize(req, nil, &Opts{RequestSizeComponents: tt.components}); got != tt.want {
+			t.Errorf("requestSize(%b) = %d, want %d", tt.components, got, tt.want)
+		}
+	}
+}
+
+func Test_requestSizeCheap(t *testing.T) {
+	req := httptest.NewRequest("POST", "/search?q=go", strings.NewReader("body"))
+	if got := requestSize(req, nil, &Opts{CheapRequestSize: true}); got != 4 {
+		t.Errorf("requestSize() = %d, want the Content-Length 4", got)
+	}
+
+	req.ContentLength = -1
+	if got := requestSize(req, nil, &Opts{CheapRequestSize: true}); got != 0 {
+		t.Errorf("requestSize() of an unknown Content-Length = %d, want 0", got)
+	}
+}
+
+func BenchmarkRequestSize(b *testing.B) {
+	req := httptest.NewRequest("POST", "/search?q=go", strings.NewReader("body"))
+	for _, name := range []string{"Accept", "Accept-Encoding", "Authorization", "Content-Type", "Cookie", "User-Agent", "X-Request-Id"} {
+		req.Header.Set(name, "a typical header value of some length")
+	}
+
+	modes := []struct {
+		name string
+		opts Opts
+	}{
+		{"cheap", Opts{CheapRequestSize: true}},
+		{"approximate", Opts{}},
+		{"accurate", Opts{AccurateRequestLine: true}},
+	}
+	for _, mode := range modes {
+		b.Run(mode.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				requestSize(req, nil, &mode.opts)
+			}
+		})
+	}
+}
+
+func Test_requestSizeAccurateRequestLine(t *testing.T) {
+	req := httptest.NewRequest("GET", "/search?q=go", nil)
+
+	// "GET /search?q=go HTTP/1.1\r\n" adds "?q=go", two spaces and the CRLF to the approximation.
+	if got, want := requestSize(req, nil, &Opts{AccurateRequestLine: true})-requestSize(req, nil, &Opts{}), 9; got != want {
+		t.Errorf("request line adds %d bytes, want %d", got, want)
+	}
+
+	req = httptest.NewRequest("GET", "/search", nil)
+	if got, want := requestSize(req, nil, &Opts{AccurateRequestLine: true})-requestSize(req, nil, &Opts{}), 4; got != want {
+		t.Errorf("request line without query adds %d bytes, want %d", got, want)
+	}
+}
+
+func Test_InstrumentDefaultStatus(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got := readMetric(t, middleware.request.WithLabelValues("200", "get", "/")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests of a handler writing nothing labelled 200 = %v, want 1", got)
+	}
+}
+
+func Test_InstrumentTrackHeaderSizes(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		TrackHeaderSizes: []string{"cookie", "Authorization", "Set-Cookie"},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=22")
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", strings.Repeat("x", 3000))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	tests := []struct {
+		header string
+		count  uint64
+		sum    float64
+	}{
+		{"Cookie", 1, 3000},
+		{"Authorization", 0, 0},
+		{"Set-Cookie", 1, 7},
+	}
+	for _, tt := range tests {
+		histogram := readMetric(t, middleware.headerBytes.WithLabelValues(tt.header).(prometheus.Metric)).GetHistogram()
+		if histogram.GetSampleCount() != tt.count || histogram.GetSampleSum() != tt.sum {
+			t.Errorf("%s = %d samples summing to %v, want %d summing to %v",
+				tt.header, histogram.GetSampleCount(), histogram.GetSampleSum(), tt.count, tt.sum)
+		}
+	}
+}
+
+func Test_InstrumentRateLimitRemaining(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:              []prometheus.Registerer{prometheus.NewRegistry()},
+		RateLimitRemainingHeader: "X-RateLimit-Remaining",
+	})
+
+	remaining := ""
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if remaining != "" {
+			w.Header().Set("X-RateLimit-Remaining", remaining)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for _, tt := range []struct {
+		header string
+		want   float64
+	}{
+		{"42", 42},
+		{"41", 41},
+		{"", 41},
+		{"unlimited", 41},
+		{" 0 ", 0},
+	} {
+		remaining = tt.header
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+		if got := readMetric(t, middleware.rateLimit.WithLabelValues("/")).GetGauge().GetValue(); got != tt.want {
+			t.Errorf("remaining after %q = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func Test_InstrumentLatencySummary(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:              []prometheus.Registerer{prometheus.NewRegistry()},
+		AlsoRecordLatencySummary: true,
+		LatencySummaryObjectives: map[float64]float64{0.99: 0.001},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for i := 0; i < 3; i++ {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+
+	histogram := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	summary := readMetric(t, middleware.latencySum.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetSummary()
+	if summary.GetSampleCount() != 3 || summary.GetSampleSum() != histogram.GetSampleSum() {
+		t.Errorf("summary = %d samples summing to %v, want the %d samples summing to %v of the histogram",
+			summary.GetSampleCount(), summary.GetSampleSum(), histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	if len(summary.GetQuantile()) != 1 || summary.GetQuantile()[0].GetQuantile() != 0.99 {
+		t.Errorf("summary quantiles = %v, want 0.99", summary.GetQuantile())
+	}
+}
+
+func Test_InstrumentLatencyMillis(t *testing.T) {
+	begin := time.Now()
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:       []prometheus.Registerer{prometheus.NewRegistry()},
+		Buckets:           []float64{0.1, 0.5},
+		EmitLatencyMillis: true,
+		Now:               fakeClock(begin, begin.Add(250*time.Millisecond)),
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	seconds := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	millis := readMetric(t, middleware.latencyMs.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	if seconds.GetSampleSum() != 0.25 || millis.GetSampleSum() != 250 {
+		t.Errorf("durations = %vs and %vms, want 0.25s and 250ms", seconds.GetSampleSum(), millis.GetSampleSum())
+	}
+	for i, bucket := range millis.GetBucket() {
+		if want := seconds.GetBucket()[i]; bucket.GetUpperBound() != want.GetUpperBound()*1000 || bucket.GetCumulativeCount() != want.GetCumulativeCount() {
+			t.Errorf("bucket %d = %v, want %v in milliseconds", i, bucket, want)
+		}
+	}
+}
+
+func Test_InstrumentLabelCompressed(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:     []prometheus.Registerer{prometheus.NewRegistry()},
+		LabelCompressed: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	req.Header.Set("Accept-Encoding", "gzip")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	for compressed, want := range map[string]uint64{"false": 1, "true": 2} {
+		labels := prometheus.Labels{"code": "200", "method": "get", "path": "/", "compressed": compressed}
+		if got := readMetric(t, middleware.latency.With(labels).(prometheus.Metric)).GetHistogram().GetSampleCount(); got != want {
+			t.Errorf("compressed=%s samples = %d, want %d", compressed, got, want)
+		}
+	}
+}
+
+func Test_InstrumentSkipsMetricsPath(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{registry},
+		MetricsPath: "/metrics",
+	})
+
+	r := mux.NewRouter()
+	r.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	if !strings.Contains(body, `http_requests_total{code="200",method="get",path="/"} 1`) {
+		t.Errorf("metrics do not contain the request of /:\n%s", body)
+	}
+	if strings.Contains(body, `path="/metrics"`) {
+		t.Errorf("metrics contain the scrapes of /metrics:\n%s", body)
+	}
+}
+
+func Test_InstrumentSizeAsSummary(t *testing.T) {
+	objectives := map[float64]float64{0.5: 0.05, 0.99: 0.001}
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:    []prometheus.Registerer{prometheus.NewRegistry()},
+		SizeAsSummary:  true,
+		SizeObjectives: objectives,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	for name, vec := range map[string]prometheus.ObserverVec{"request": middleware.reqSize, "response": middleware.resSize} {
+		if _, ok := vec.(*prometheus.SummaryVec); !ok {
+			t.Fatalf("%s size collector is a %T, want a summary", name, vec)
+		}
+		summary := readMetric(t, vec.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetSummary()
+		if summary.GetSampleCount() != 1 {
+			t.Errorf("%s size sample count = %d, want 1", name, summary.GetSampleCount())
+		}
+		quantiles := summary.GetQuantile()
+		if len(quantiles) != len(objectives) {
+			t.Fatalf("%s size quantiles = %v, want %v", name, quantiles, objectives)
+		}
+		for _, quantile := range quantiles {
+			if _, ok := objectives[quantile.GetQuantile()]; !ok {
+				t.Errorf("%s size has quantile %v, want one of %v", name, quantile.GetQuantile(), objectives)
+			}
+		}
+	}
+}
+
+func Test_InstrumentSizeObservers(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:          []prometheus.Registerer{prometheus.NewRegistry()},
+		RequestSizeObserver:  &SizeObserver{Summary: true, Objectives: map[float64]float64{0.9: 0.01}},
+		ResponseSizeObserver: &SizeObserver{Buckets: []float64{10, 100}},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	summary := readMetric(t, middleware.reqSize.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetSummary()
+	if len(summary.GetQuantile()) != 1 || summary.GetQuantile()[0].GetQuantile() != 0.9 {
+		t.Errorf("request size quantiles = %v, want 0.9", summary.GetQuantile())
+	}
+	histogram := readMetric(t, middleware.resSize.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	if buckets := histogram.GetBucket(); len(buckets) != 2 || buckets[0].GetUpperBound() != 10 || buckets[0].GetCumulativeCount() != 1 {
+		t.Errorf("response size buckets = %v, want 5 bytes in 10 and 100", buckets)
+	}
+}
+
+func Test_InstrumentTimeToHeaders(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := begin
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+		TrackTimeToHeaders: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/explicit", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "body")
+	})
+	r.HandleFunc("/implicit", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "body")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/explicit", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/implicit", nil))
+
+	explicit := readMetric(t, middleware.headers.WithLabelValues("202", "get", "/explicit").(prometheus.Metric)).GetHistogram()
+	if explicit.GetSampleSum() != 1 {
+		t.Errorf("time to headers of the explicit status = %v, want 1", explicit.GetSampleSum())
+	}
+	implicit := readMetric(t, middleware.headers.WithLabelValues("200", "get", "/implicit").(prometheus.Metric)).GetHistogram()
+	if implicit.GetSampleSum() != 1 {
+		t.Errorf("time to headers of the implicit status = %v, want 1", implicit.GetSampleSum())
+	}
+}
+
+func Test_InstrumentMeasureUntilFlushed(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := begin
+	flushes := 0
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Now: func() time.Time {
+			return now
+		},
+		MeasureUntilFlushed: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		now = now.Add(time.Second)
+		fmt.Fprint(w, "first event")
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, "last event")
+	})
+	r.HandleFunc("/buffered", func(w http.ResponseWriter, r *http.Request) {
+		now = now.Add(time.Second)
+		fmt.Fprint(w, "buffered body")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	newRecorder := func() *slowFlushRecorder {
+		return &slowFlushRecorder{ResponseRecorder: httptest.NewRecorder(), flush: func() {
+			now = now.Add(2 * time.Second)
+			flushes++
+		}}
+	}
+	r.ServeHTTP(newRecorder(), httptest.NewRequest("GET", "/stream", nil))
+	r.ServeHTTP(newRecorder(), httptest.NewRequest("GET", "/buffered", nil))
+
+	if flushes != 2 {
+		t.Errorf("flushes = %d, want 2: the handler's and the rest of its stream", flushes)
+	}
+	latency := readMetric(t, middleware.latency.WithLabelValues("200", "get", "/stream").(prometheus.Metric)).GetHistogram()
+	if latency.GetSampleSum() != 5 {
+		t.Errorf("streamed latency = %v, want 5", latency.GetSampleSum())
+	}
+	latency = readMetric(t, middleware.latency.WithLabelValues("200", "get", "/buffered").(prometheus.Metric)).GetHistogram()
+	if latency.GetSampleSum() != 1 {
+		t.Errorf("buffered latency = %v, want 1", latency.GetSampleSum())
+	}
+}
+
+func Test_InstrumentMeasureUntilFlushedKeepsContentLength(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:         []prometheus.Registerer{prometheus.NewRegistry()},
+		MeasureUntilFlushed: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/buffered", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/buffered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.ContentLength != 5 || res.Header.Get("Content-Length") != "5" {
+		t.Errorf("Content-Length = %q, want 5", res.Header.Get("Content-Length"))
+	}
+	if len(res.TransferEncoding) != 0 {
+		t.Errorf("Transfer-Encoding = %v, want none", res.TransferEncoding)
+	}
+}
+
+type slowFlushRecorder struct {
+	*httptest.ResponseRecorder
+	flush func()
+}
+
+func (s *slowFlushRecorder) Flush() {
+	s.flush()
+	s.ResponseRecorder.Flush()
+}
+
+func Test_InstrumentDeadlineSlack(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := begin
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+		TrackDeadlineSlack: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	serve := func(deadline time.Time) {
+		req := httptest.NewRequest("GET", "/", nil)
+		if !deadline.IsZero() {
+			ctx, cancel := context.WithDeadline(req.Context(), deadline)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve(begin.Add(5 * time.Second)) // served from 1s to 2s, 3s left
+	serve(begin.Add(time.Second))     // served from 3s to 4s, overran
+	serve(time.Time{})
+
+	slack := readMetric(t, middleware.slack.WithLabelValues("200", "get", "/").(prometheus.Metric)).GetHistogram()
+	if slack.GetSampleCount() != 2 {
+		t.Errorf("observed %d requests, want the 2 with a deadline", slack.GetSampleCount())
+	}
+	if slack.GetSampleSum() != 3 {
+		t.Errorf("slack = %v, want 3", slack.GetSampleSum())
+	}
+	if overran := slack.GetBucket()[0]; overran.GetUpperBound() != 0 || overran.GetCumulativeCount() != 1 {
+		t.Errorf("first bucket = %v, want the overrun request below 0", overran)
+	}
+}
+
+func Test_InstrumentRouteIdentityFunc(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		RouteIdentityFunc: func(r *http.Request) string {
+			if name := MuxRouteName(r); name != "" {
+				return "api:" + name
+			}
+			return ""
+		},
+	})
+
+	r := mux.NewRouter()
+	api := r.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {}).Name("users")
+	api.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/orders", nil))
+
+	for path, route := range map[string]string{"/api/users": "api:users", "/api/orders": "/api/orders"} {
+		counter := middleware.request.With(prometheus.Labels{"code": "200", "method": "get", "path": path, "route": route})
+		if got := readMetric(t, counter).GetCounter().GetValue(); got != 1 {
+			t.Errorf("requests of route %q = %v, want 1", route, got)
+		}
+	}
+}
+
+func Test_InstrumentSizeMetricsOnErrorsOnly(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:             []prometheus.Registerer{prometheus.NewRegistry()},
+		SizeMetricsOnErrorsOnly: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "0" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprint(w, "body")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/0", nil))
+
+	for code, want := range map[string]uint64{"200": 0, "404": 1} {
+		resSize := readMetric(t, middleware.resSize.WithLabelValues(code, "get", "/users/{id}").(prometheus.Metric))
+		if got := resSize.GetHistogram().GetSampleCount(); got != want {
+			t.Errorf("response sizes of %s = %d, want %d", code, got, want)
+		}
+		if got := readMetric(t, middleware.request.WithLabelValues(code, "get", "/users/{id}")).GetCounter().GetValue(); got != 1 {
+			t.Errorf("requests of %s = %v, want 1", code, got)
+		}
+	}
+}
+
+func Test_InstrumentDetailedCodes(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:   []prometheus.Registerer{prometheus.NewRegistry()},
+		DetailedCodes: []int{http.StatusNotFound, http.StatusInternalServerError},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/status/{code}", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(mux.Vars(r)["code"])
+		w.WriteHeader(code)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for _, code := range []string{"200", "204", "302", "404", "500"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status/"+code, nil))
+	}
+
+	for code, want := range map[string]float64{"ok": 3, "404": 1, "500": 1} {
+		if got := readMetric(t, middleware.request.WithLabelValues(code, "get", "/status/{code}")).GetCounter().GetValue(); got != want {
+			t.Errorf("requests of code %s = %v, want %v", code, got, want)
+		}
+	}
+}
+
+// fakeClock returns an Opts.Now reading the given times in turn, one per call.
+func fakeClock(times ...time.Time) func() time.Time {
+	return func() time.Time {
+		now := times[0]
+		times = times[1:]
+		return now
+	}
+}
+
+func readMetric(t *testing.T, metric prometheus.Metric) *dto.Metric {
+	t.Helper()
+
+	var m dto.Metric
+	if err := metric.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
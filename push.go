@@ -0,0 +1,28 @@
+package prometheusmiddleware
+
+import (
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushTo pushes the current value of the middleware's metrics to the Pushgateway at url
+// under the given job name, grouped by Opts.PushGrouping. Any metric previously pushed
+// with the same job and grouping is replaced. It is meant to be called on shutdown of
+// short-lived jobs that cannot be scraped. Opts.RequestCounter and Opts.LatencyHistogram
+// are pushed when the middleware records into them, although it does not register them.
+func (p *PrometheusMiddleware) PushTo(url, jobName string) error {
+	pusher := push.New(url, jobName)
+	for _, c := range p.collectors {
+		pusher = pusher.Collector(c.Collector)
+	}
+	if p.request == p.opts.RequestCounter {
+		pusher = pusher.Collector(p.request)
+	}
+	if p.latency == p.opts.LatencyHistogram {
+		pusher = pusher.Collector(p.latency)
+	}
+	for name, value := range p.opts.PushGrouping {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	return pusher.Push()
+}
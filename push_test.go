@@ -0,0 +1,70 @@
+package prometheusmiddleware
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_PushTo(t *testing.T) {
+	var path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		path, body = r.URL.Path, string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:  []prometheus.Registerer{prometheus.NewRegistry()},
+		PushGrouping: map[string]string{"instance": "worker-1"},
+	})
+	middleware.request.WithLabelValues("200", "get", "/").Inc()
+
+	if err := middleware.PushTo(gateway.URL, "batch"); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/metrics/job/batch/instance/worker-1" {
+		t.Errorf("pushed to '%s'", path)
+	}
+	if !strings.Contains(body, requestName) {
+		t.Errorf("pushed body does not contain request total entry '%s'", requestName)
+	}
+}
+
+func Test_PushToProvidedCollectors(t *testing.T) {
+	var body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "shared_requests_total", Help: "Shared."}, []string{"code", "method", "path"})
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "shared_request_seconds", Help: "Shared."}, []string{"code", "method", "path"})
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		RequestCounter:   counter,
+		LatencyHistogram: histogram,
+		PathLabelFunc:    func(r *http.Request) string { return "/" },
+	})
+
+	handler := middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if err := middleware.PushTo(gateway.URL, "batch"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"shared_requests_total", "shared_request_seconds", responseSizeName} {
+		if !strings.Contains(body, name) {
+			t.Errorf("pushed body does not contain %s", name)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package prometheusmiddleware
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// queryLabel is a query parameter recorded as a label, as configured by Opts.QueryParamLabels.
+type queryLabel struct {
+	param  string
+	name   string
+	values map[string]struct{}
+}
+
+// newQueryLabels returns the labels of Opts.QueryParamLabels. Parameters whose label name is
+// the one of a previous parameter, like "page-size" and "page_size", are logged and dropped as
+// the collectors could not be registered with the same label twice.
+func newQueryLabels(opts Opts) []queryLabel {
+	labels := make([]queryLabel, 0, len(opts.QueryParamLabels))
+	params := make(map[string]string, len(opts.QueryParamLabels)) // label name -> parameter
+	for _, param := range opts.QueryParamLabels {
+		name := queryLabelName(param)
+		if other, ok := params[name]; ok {
+			opts.logger().Println("query parameter " + strconv.Quote(param) + " was not labeled: " + name + " is the label of " + strconv.Quote(other))
+			continue
+		}
+		params[name] = param
+
+		values := make(map[string]struct{}, len(opts.QueryParamValues[param]))
+		for _, value := range opts.QueryParamValues[param] {
+			values[value] = struct{}{}
+		}
+		labels = append(labels, queryLabel{param: param, name: name, values: values})
+	}
+	return labels
+}
+
+// queryLabelName returns the label name of the query parameter: "query_" followed by the
+// parameter, whose characters invalid in label names are replaced by "_".
+func queryLabelName(param string) string {
+	return "query_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, param)
+}
+
+// value returns the label value of the query parameter among the parsed query of the request:
+// its first value when allowed, "other" when not, and "none" when the parameter is missing.
+func (q queryLabel) value(query url.Values) string {
+	values, ok := query[q.param]
+	if !ok || len(values) == 0 {
+		return "none"
+	}
+	if _, ok := q.values[values[0]]; !ok {
+		return "other"
+	}
+	return values[0]
+}
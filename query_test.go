@@ -0,0 +1,58 @@
+package prometheusmiddleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_queryLabelName(t *testing.T) {
+	for param, want := range map[string]string{"type": "query_type", "page-size": "query_page_size", "a.b": "query_a_b"} {
+		if got := queryLabelName(param); got != want {
+			t.Errorf("queryLabelName(%q) = %s, want %s", param, got, want)
+		}
+	}
+}
+
+func Test_InstrumentQueryParamLabels(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		QueryParamLabels: []string{"type"},
+		QueryParamValues: map[string][]string{"type": {"image", "video"}},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	for _, target := range []string{"/search?type=image", "/search?type=video&q=cats", "/search?type=image", "/search?type=pdf", "/search"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	for value, want := range map[string]float64{"image": 2, "video": 1, "other": 1, "none": 1} {
+		counter := middleware.request.With(prometheus.Labels{"code": "200", "method": "get", "path": "/search", "query_type": value})
+		if got := readMetric(t, counter).GetCounter().GetValue(); got != want {
+			t.Errorf("requests of type %q = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func Test_newQueryLabelsDuplicates(t *testing.T) {
+	var buf bytes.Buffer
+	labels := newQueryLabels(Opts{
+		Logger:           log.New(&buf, "", 0),
+		QueryParamLabels: []string{"page-size", "type", "page_size"},
+	})
+
+	if len(labels) != 2 || labels[0].param != "page-size" || labels[1].param != "type" {
+		t.Errorf("labels = %+v, want page-size and type", labels)
+	}
+	if want := "query parameter \"page_size\" was not labeled: query_page_size is the label of \"page-size\"\n"; buf.String() != want {
+		t.Errorf("logged %q, want %q", buf.String(), want)
+	}
+}
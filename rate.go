@@ -0,0 +1,93 @@
+package prometheusmiddleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rateWindow counts the requests of the latest seconds, in a bucket per second, to expose
+// the request rate over a sliding window.
+type rateWindow struct {
+	gauge prometheus.GaugeFunc
+
+	mu      sync.Mutex
+	buckets []uint64
+	current int
+
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func newRateWindow(opts Opts) *rateWindow {
+	seconds := int(opts.RateWindow / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w := &rateWindow{
+		buckets: make([]uint64, seconds),
+		stopped: make(chan struct{}),
+	}
+	w.gauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   opts.Namespace,
+			Name:        rateName,
+			Help:        "How many HTTP requests were processed per second over the rate window.",
+			Subsystem:   opts.Subsystem,
+			ConstLabels: opts.ConstLabels,
+		},
+		w.rate,
+	)
+	return w
+}
+
+// run moves the window every second until the window is stopped.
+func (w *rateWindow) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.tick()
+		case <-w.stopped:
+			return
+		}
+	}
+}
+
+// tick starts the bucket of a new second, dropping the oldest one.
+func (w *rateWindow) tick() {
+	w.mu.Lock()
+	w.current = (w.current + 1) % len(w.buckets)
+	w.buckets[w.current] = 0
+	w.mu.Unlock()
+}
+
+// inc counts a request in the bucket of the current second.
+func (w *rateWindow) inc() {
+	w.mu.Lock()
+	w.buckets[w.current]++
+	w.mu.Unlock()
+}
+
+// rate returns the average number of requests per second over the window.
+func (w *rateWindow) rate() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var total uint64
+	for _, count := range w.buckets {
+		total += count
+	}
+	return float64(total) / float64(len(w.buckets))
+}
+
+// stop stops moving the window. It can be called several times.
+func (w *rateWindow) stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopped)
+	})
+}
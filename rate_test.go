@@ -0,0 +1,49 @@
+package prometheusmiddleware
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_rateWindow(t *testing.T) {
+	w := newRateWindow(Opts{RateWindow: 4 * time.Second})
+
+	for second, requests := range []int{8, 4, 0, 4} {
+		if second > 0 {
+			w.tick()
+		}
+		for i := 0; i < requests; i++ {
+			w.inc()
+		}
+	}
+	if got := w.rate(); got != 4 {
+		t.Errorf("rate() = %v, want 4", got)
+	}
+
+	w.tick() // the 8 requests of the first second leave the window
+	if got := w.rate(); got != 2 {
+		t.Errorf("rate() after a second = %v, want 2", got)
+	}
+}
+
+func Test_ShutdownStopsRateWindow(t *testing.T) {
+	middleware := &PrometheusMiddleware{rate: newRateWindow(Opts{RateWindow: time.Second})}
+	done := make(chan struct{})
+	go func() {
+		middleware.rate.run()
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := middleware.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("rate window still running after Shutdown")
+	}
+}
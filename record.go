@@ -0,0 +1,231 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// observation is what was measured of a request, recorded into the collectors
+// on the request goroutine or, in async mode, by the recorder goroutine.
+type observation struct {
+	labels    prometheus.Labels
+	status    int
+	panicked  bool
+	truncated bool
+	path      string
+	elapsed   time.Duration
+	ttfb      time.Duration
+	headers   time.Duration
+	bodyRead  time.Duration // negative when the handler did not read the body
+	delay     time.Duration // negative when the context held no enqueue time
+	slack     time.Duration
+	hasSlack  bool
+	reqSize   int
+	resSize   int64
+	streaming bool
+	exemplar  prometheus.Labels
+
+	inflated    int64
+	hasInflated bool
+
+	reqHeaderSize int
+	resHeaderSize int
+	headerSizes   []int // of Opts.TrackHeaderSizes, negative when absent
+
+	rateLimit    float64
+	hasRateLimit bool
+
+	client     string
+	phases     map[string]time.Duration
+	rejected   bool
+	cacheable  string
+	missing    []string
+	tlsVersion string
+	tls        bool
+	tlsResumed bool
+}
+
+// clamp caps a duration of the request to Opts.MaxLatencyClamp, when set.
+func (p *PrometheusMiddleware) clamp(d time.Duration) time.Duration {
+	if max := p.opts.MaxLatencyClamp; max > 0 && d > max {
+		return max
+	}
+	return d
+}
+
+// record observes the measures of a request into the collectors.
+func (p *PrometheusMiddleware) record(o *observation) {
+	code, method, path := o.labels["code"], o.labels["method"], o.path
+
+	if p.request == p.opts.RequestCounter {
+		p.request.With(labelSubset(o.labels, p.requestLabels)).Inc()
+	} else {
+		p.request.WithLabelValues(labelValues(o.labels, p.requestLabels)...).Inc()
+	}
+	if p.rate != nil {
+		p.rate.inc()
+	}
+	if p.clients != nil && o.client != "" {
+		p.clients.add(o.client)
+	}
+
+	if !o.streaming {
+		// The observation is shared with the slow request logger, which logs the raw duration.
+		elapsed := p.clamp(o.elapsed)
+		if elapsed != o.elapsed && p.clamped != nil {
+			p.clamped.WithLabelValues(path).Inc()
+		}
+
+		if p.latency == p.opts.LatencyHistogram {
+			p.observeLatency(p.latency.With(labelSubset(o.labels, p.latencyLabels)), elapsed, o.exemplar)
+		} else {
+			p.observeLatency(p.latency.WithLabelValues(labelValues(o.labels, p.latencyLabels)...), elapsed, o.exemplar)
+		}
+
+		if p.latencyMs != nil {
+			p.latencyMs.WithLabelValues(labelValues(o.labels, p.latencyLabels)...).Observe(float64(elapsed) / float64(time.Millisecond))
+		}
+
+		if p.latencySum != nil {
+			p.latencySum.WithLabelValues(labelValues(o.labels, p.latencyLabels)...).Observe(seconds(elapsed))
+		}
+
+		if p.outcome != nil {
+			p.outcome.WithLabelValues(outcome(o.status), path).Observe(seconds(elapsed))
+		}
+
+		if p.slowest != nil {
+			p.slowest.observe(path, seconds(elapsed))
+		}
+
+		if p.digests != nil {
+			p.digests.observe(path, seconds(elapsed))
+		}
+
+		if _, ok := p.fineRoutes[path]; ok {
+			p.fine.WithLabelValues(code, method, path).Observe(seconds(elapsed))
+		}
+
+		if p.ttfb != nil {
+			p.ttfb.WithLabelValues(code, method, path).Observe(seconds(p.clamp(o.ttfb)))
+		}
+
+		if p.headers != nil {
+			p.headers.WithLabelValues(code, method, path).Observe(seconds(p.clamp(o.headers)))
+		}
+
+		if p.bodyRead != nil && o.bodyRead >= 0 {
+			p.bodyRead.WithLabelValues(code, method, path).Observe(seconds(p.clamp(o.bodyRead)))
+		}
+
+		if !p.opts.SizeMetricsOnErrorsOnly || o.status >= http.StatusBadRequest {
+			p.reqSize.WithLabelValues(code, method, path).Observe(float64(o.reqSize))
+			p.resSize.WithLabelValues(labelValues(o.labels, p.resSizeLabels)...).Observe(float64(o.resSize))
+
+			if o.hasInflated {
+				p.inflated.WithLabelValues(code, method, path).Observe(float64(o.inflated))
+			}
+
+			if p.sizeRatio != nil && o.reqSize > 0 {
+				p.sizeRatio.WithLabelValues(code, method, path).Observe(float64(o.resSize) / float64(o.reqSize))
+			}
+		}
+	}
+
+	if p.reqBytes != nil {
+		p.reqBytes.WithLabelValues(path).Add(float64(o.reqSize))
+		p.resBytes.WithLabelValues(path).Add(float64(o.resSize))
+	}
+
+	if p.reqHeaderSize != nil {
+		p.reqHeaderSize.WithLabelValues(code, method, path).Observe(float64(o.reqHeaderSize))
+		p.resHeaderSize.WithLabelValues(code, method, path).Observe(float64(o.resHeaderSize))
+	}
+
+	for i, size := range o.headerSizes {
+		if size >= 0 {
+			p.headerBytes.WithLabelValues(p.opts.TrackHeaderSizes[i]).Observe(float64(size))
+		}
+	}
+
+	if o.hasRateLimit {
+		p.rateLimit.WithLabelValues(path).Set(o.rateLimit)
+	}
+
+	for phase, d := range o.phases {
+		if _, ok := p.phases[phase]; ok {
+			p.phase.WithLabelValues(path, phase).Observe(seconds(p.clamp(d)))
+		}
+	}
+
+	if o.truncated && p.truncated != nil {
+		p.truncated.WithLabelValues(path).Inc()
+	}
+
+	if o.delay >= 0 && p.delay != nil {
+		p.delay.Observe(seconds(o.delay))
+	}
+
+	if o.hasSlack {
+		if o.slack < 0 {
+			o.slack = 0
+		}
+		p.slack.WithLabelValues(code, method, path).Observe(seconds(o.slack))
+	}
+
+	if o.panicked && p.panics != nil {
+		p.panics.WithLabelValues(path).Inc()
+	}
+
+	if o.rejected {
+		p.rejected.WithLabelValues(path).Inc()
+	}
+
+	if o.cacheable != "" {
+		p.validators.WithLabelValues(path, o.cacheable).Inc()
+	}
+
+	for _, header := range o.missing {
+		p.missing.WithLabelValues(header, path).Inc()
+	}
+
+	if o.tls && o.tlsResumed {
+		p.tlsResumed.Inc()
+	} else if o.tls {
+		p.tlsFull.Inc()
+	}
+
+	if p.tlsVersion != nil {
+		p.tlsVersion.WithLabelValues(o.tlsVersion).Inc()
+	}
+}
+
+// observeLatency observes the duration, attaching the exemplar when there is one,
+// which is when Opts.ExemplarLabels is set and the request took longer than Opts.ExemplarThreshold.
+func (p *PrometheusMiddleware) observeLatency(observer prometheus.Observer, elapsed time.Duration, exemplar prometheus.Labels) {
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && len(exemplar) > 0 {
+		exemplarObserver.ObserveWithExemplar(seconds(elapsed), exemplar)
+		return
+	}
+
+	observer.Observe(seconds(elapsed))
+}
+
+// outcome returns the outcome label of a status code.
+func outcome(status int) string {
+	switch {
+	case status >= 500:
+		return "server_error"
+	case status >= 400:
+		return "client_error"
+	default:
+		return "success"
+	}
+}
+
+// seconds converts the duration to seconds.
+func seconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Second)
+}
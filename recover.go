@@ -0,0 +1,41 @@
+package prometheusmiddleware
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// serveRecovering serves the request, recovering a panic of the handler as Opts.RecoverPanics
+// describes. It reports whether the handler panicked. http.ErrAbortHandler is not recovered, as
+// it is how handlers abort a response on purpose. recorder is the Opts.WrapResponseWriter the
+// handler wrote to, if any.
+func (p *PrometheusMiddleware) serveRecovering(next http.Handler, w http.ResponseWriter, r *http.Request, delegate *responseWriterDelegator, recorder ResponseRecorder) (panicked bool) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		if v == http.ErrAbortHandler {
+			panic(v)
+		}
+
+		panicked = true
+		line := fmt.Sprintf("prometheusMiddleware recovered a panic serving %s %s: %v", r.Method, r.URL.Path, v)
+		if !p.opts.DisablePanicStack {
+			line += "\n" + string(debug.Stack())
+		}
+		p.opts.logger().Println(line)
+
+		// The writes through a recorder do not go through the delegate.
+		if recorder != nil {
+			delegate.recordedBy(recorder)
+		}
+		if !delegate.wroteHeader && !delegate.hijacked {
+			delegate.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	next.ServeHTTP(w, r)
+	return false
+}
@@ -0,0 +1,149 @@
+package prometheusmiddleware
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_InstrumentRecoverPanics(t *testing.T) {
+	var buf bytes.Buffer
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:   []prometheus.Registerer{prometheus.NewRegistry()},
+		Logger:        log.New(&buf, "", 0),
+		RecoverPanics: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		panic("nil user")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/users/42", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	if got := readMetric(t, middleware.panics.WithLabelValues("/users/{id}")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("panics = %v, want 1", got)
+	}
+	if got := readMetric(t, middleware.request.WithLabelValues("500", "get", "/users/{id}")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests = %v, want 1 with the 500 status", got)
+	}
+
+	logged := buf.String()
+	if !strings.HasPrefix(logged, "prometheusMiddleware recovered a panic serving GET /users/42: nil user\n") {
+		t.Errorf("logged %q, want the recovered value", logged)
+	}
+	if !strings.Contains(logged, "runtime/debug.Stack") {
+		t.Errorf("logged %q, want the stack trace", logged)
+	}
+}
+
+func Test_InstrumentRecoverPanicsWithoutStack(t *testing.T) {
+	var buf bytes.Buffer
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:       []prometheus.Registerer{prometheus.NewRegistry()},
+		Logger:            log.New(&buf, "", 0),
+		RecoverPanics:     true,
+		DisablePanicStack: true,
+		PathLabelFunc:     func(r *http.Request) string { return "/" },
+	})
+
+	handler := middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("late failure")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want the 202 already written", w.Code)
+	}
+	if want := "prometheusMiddleware recovered a panic serving GET /: late failure\n"; buf.String() != want {
+		t.Errorf("logged %q, want %q", buf.String(), want)
+	}
+}
+
+func Test_InstrumentRecoverPanicsAfterWriteHeader(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:   []prometheus.Registerer{prometheus.NewRegistry()},
+		Logger:        log.New(ioutil.Discard, "", 0),
+		RecoverPanics: true,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("late failure")
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/users/42", nil))
+
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status sent = %d, want the 202 written before the panic", w.Code)
+	}
+	if got := middleware.Snapshot().RequestsByPath["/users/{id}"]; got != 1 {
+		t.Errorf("requests = %d, want 1", got)
+	}
+	if got := readMetric(t, middleware.request.WithLabelValues("500", "get", "/users/{id}")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests recorded with a 500 = %v, want 1 whatever status was sent", got)
+	}
+}
+
+func Test_InstrumentRecoverPanicsWrappedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var tracking *trackingWriter
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:   []prometheus.Registerer{prometheus.NewRegistry()},
+		Logger:        log.New(&buf, "", 0),
+		RecoverPanics: true,
+		PathLabelFunc: func(r *http.Request) string { return "/" },
+		WrapResponseWriter: func(w http.ResponseWriter) ResponseRecorder {
+			tracking = &trackingWriter{ResponseWriter: w}
+			return tracking
+		},
+	})
+
+	handler := middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		panic("late failure")
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if got := readMetric(t, middleware.request.WithLabelValues("500", "get", "/")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests = %v, want 1 recorded with a 500", got)
+	}
+	if tracking.status != http.StatusAccepted {
+		t.Errorf("status written through the recorder = %d, want the 202 the handler wrote", tracking.status)
+	}
+}
+
+func Test_InstrumentRecoverPanicsAbortHandler(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:   []prometheus.Registerer{prometheus.NewRegistry()},
+		RecoverPanics: true,
+	})
+
+	handler := middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler to be panicked again", v)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
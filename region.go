@@ -0,0 +1,93 @@
+package prometheusmiddleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const unknownRegion = "unknown"
+
+// regionClassifier resolves the bounded region label of a request.
+type regionClassifier struct {
+	classify       func(net.IP) string
+	regions        map[string]struct{}
+	header         string
+	trustedProxies []*net.IPNet
+}
+
+func newRegionClassifier(opts Opts) *regionClassifier {
+	c := &regionClassifier{
+		classify: opts.RegionClassifier,
+		regions:  make(map[string]struct{}, len(opts.Regions)),
+		header:   opts.TrustedProxyHeader,
+	}
+
+	for _, region := range opts.Regions {
+		c.regions[region] = struct{}{}
+	}
+
+	for _, cidr := range opts.TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			opts.logger().Println("trusted proxy was ignored:", err)
+			continue
+		}
+		c.trustedProxies = append(c.trustedProxies, network)
+	}
+
+	return c
+}
+
+// region returns the region of the client that sent the request, or "unknown"
+// when the client IP cannot be determined or is classified outside of the allowed regions.
+func (c *regionClassifier) region(r *http.Request) string {
+	ip := c.clientIP(r)
+	if ip == nil {
+		return unknownRegion
+	}
+
+	region := c.classify(ip)
+	if _, ok := c.regions[region]; !ok {
+		return unknownRegion
+	}
+	return region
+}
+
+// clientIP returns the IP address of the client. The proxy header is only honored
+// when the request comes from a trusted proxy, and is walked from right to left
+// skipping trusted proxies, so that a client cannot spoof its address by sending the header itself.
+func (c *regionClassifier) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || c.header == "" || !c.trusted(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values(c.header), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+		if !c.trusted(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (c *regionClassifier) trusted(ip net.IP) bool {
+	for _, network := range c.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
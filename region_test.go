@@ -0,0 +1,59 @@
+package prometheusmiddleware
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func Test_regionClassifier(t *testing.T) {
+	c := newRegionClassifier(Opts{
+		RegionClassifier: func(ip net.IP) string {
+			if ip.To4() != nil && ip.To4()[0] == 203 {
+				return "apac"
+			}
+			if ip.To4() != nil && ip.To4()[0] == 198 {
+				return "mars"
+			}
+			return "europe"
+		},
+		Regions:            []string{"apac", "europe"},
+		TrustedProxyHeader: "X-Forwarded-For",
+		TrustedProxies:     []string{"10.0.0.0/8"},
+	})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		wantIP     string
+		wantRegion string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.1:1234", wantIP: "203.0.113.1", wantRegion: "apac"},
+		{name: "header from untrusted peer", remoteAddr: "192.0.2.1:1234", forwarded: "203.0.113.1", wantIP: "192.0.2.1", wantRegion: "europe"},
+		{name: "header from trusted proxy", remoteAddr: "10.0.0.1:1234", forwarded: "203.0.113.1", wantIP: "203.0.113.1", wantRegion: "apac"},
+		{name: "spoofed leftmost entry", remoteAddr: "10.0.0.1:1234", forwarded: "203.0.113.1, 192.0.2.1", wantIP: "192.0.2.1", wantRegion: "europe"},
+		{name: "chained trusted proxies", remoteAddr: "10.0.0.1:1234", forwarded: "203.0.113.1, 10.0.0.2", wantIP: "203.0.113.1", wantRegion: "apac"},
+		{name: "invalid entry", remoteAddr: "10.0.0.1:1234", forwarded: "garbage, 192.0.2.1", wantIP: "192.0.2.1", wantRegion: "europe"},
+		{name: "region outside of allowed set", remoteAddr: "198.51.100.1:1234", wantIP: "198.51.100.1", wantRegion: "unknown"},
+		{name: "invalid remote address", remoteAddr: "pipe", wantRegion: "unknown"},
+	}
+
+	for _, tt := range tests {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+
+		if ip := c.clientIP(r); (ip == nil && tt.wantIP != "") || (ip != nil && ip.String() != tt.wantIP) {
+			t.Errorf("%s: clientIP() = %v, want %s", tt.name, ip, tt.wantIP)
+		}
+		if region := c.region(r); region != tt.wantRegion {
+			t.Errorf("%s: region() = %s, want %s", tt.name, region, tt.wantRegion)
+		}
+	}
+}
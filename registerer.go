@@ -0,0 +1,54 @@
+package prometheusmiddleware
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Registerer returns the registerer the middleware registers its collectors into, so that
+// handlers register their own metrics alongside. With several Opts.Registerers, it registers
+// into each of them.
+func (p *PrometheusMiddleware) Registerer() prometheus.Registerer {
+	if len(p.opts.Registerers) == 1 {
+		return p.opts.Registerers[0]
+	}
+	return multiRegisterer(p.opts.Registerers)
+}
+
+// ConstLabels returns a copy of the constant labels of the collectors of the middleware.
+func (p *PrometheusMiddleware) ConstLabels() prometheus.Labels {
+	labels := make(prometheus.Labels, len(p.opts.ConstLabels))
+	for name, value := range p.opts.ConstLabels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// multiRegisterer registers collectors into several registerers.
+type multiRegisterer []prometheus.Registerer
+
+// Register registers the collector into every registerer, returning the first error.
+func (m multiRegisterer) Register(c prometheus.Collector) error {
+	var first error
+	for _, registerer := range m {
+		if err := registerer.Register(c); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m multiRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, registerer := range m {
+		registerer.MustRegister(cs...)
+	}
+}
+
+// Unregister unregisters the collector from every registerer, reporting whether it was
+// unregistered from any.
+func (m multiRegisterer) Unregister(c prometheus.Collector) bool {
+	unregistered := false
+	for _, registerer := range m {
+		if registerer.Unregister(c) {
+			unregistered = true
+		}
+	}
+	return unregistered
+}
@@ -0,0 +1,178 @@
+package prometheusmiddleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_Registerer(t *testing.T) {
+	first, second := prometheus.NewRegistry(), prometheus.NewRegistry()
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{first, second},
+		ConstLabels: prometheus.Labels{"service": "orders"},
+	})
+
+	labels := middleware.ConstLabels()
+	labels["service"] = "changed"
+	orderValue := prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "order_value_total",
+		Help:        "Value of the orders.",
+		ConstLabels: middleware.ConstLabels(),
+	})
+	if err := middleware.Registerer().Register(orderValue); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, registry := range []*prometheus.Registry{first, second} {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, family := range families {
+			if family.GetName() == "order_value_total" {
+				found = family.GetMetric()[0].GetLabel()[0].GetValue() == "orders"
+			}
+		}
+		if !found {
+			t.Error("order_value_total with the service label is not registered into every registry")
+		}
+	}
+
+	if !middleware.Registerer().Unregister(orderValue) {
+		t.Error("Unregister() = false, want true")
+	}
+}
+
+func Test_AddHostnameLabel(t *testing.T) {
+	defer func(original func() (string, error)) { hostname = original }(hostname)
+	hostname = func() (string, error) { return "web-1", nil }
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		ConstLabels:      prometheus.Labels{"service": "api"},
+		AddHostnameLabel: true,
+	})
+	if got, want := middleware.ConstLabels(), (prometheus.Labels{"service": "api", "instance": "web-1"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConstLabels() = %v, want %v", got, want)
+	}
+
+	middleware = NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		ConstLabels:      prometheus.Labels{"instance": "pod-7"},
+		AddHostnameLabel: true,
+	})
+	if got := middleware.ConstLabels()["instance"]; got != "pod-7" {
+		t.Errorf("instance label = %q, want the configured pod-7", got)
+	}
+}
+
+func Test_DeploymentLabel(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:     []prometheus.Registerer{registry},
+		ConstLabels:     prometheus.Labels{"service": "api"},
+		DeploymentLabel: "green",
+		CountBytes:      true,
+	})
+	if got, want := middleware.ConstLabels(), (prometheus.Labels{"service": "api", "deployment": "green"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConstLabels() = %v, want %v", got, want)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			deployment := ""
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "deployment" {
+					deployment = label.GetValue()
+				}
+			}
+			if deployment != "green" {
+				t.Errorf("%s deployment label = %q, want green", family.GetName(), deployment)
+			}
+		}
+	}
+
+	middleware = NewPrometheusMiddleware(Opts{
+		Registerers:     []prometheus.Registerer{prometheus.NewRegistry()},
+		ConstLabels:     prometheus.Labels{"deployment": "blue"},
+		DeploymentLabel: "green",
+	})
+	if got := middleware.ConstLabels()["deployment"]; got != "blue" {
+		t.Errorf("deployment label = %q, want the configured blue", got)
+	}
+}
+
+func Test_ProvidedCollectors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "stack_requests_total"}, []string{"path", "method", "code"})
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "stack_latency_seconds"}, []string{"code", "method", "path"})
+	registry.MustRegister(requests, latency)
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{registry},
+		RequestCounter:   requests,
+		LatencyHistogram: latency,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+
+	if counter := readMetric(t, requests.WithLabelValues("/users", "get", "200")).GetCounter(); counter.GetValue() != 1 {
+		t.Errorf("provided request count = %v, want 1", counter.GetValue())
+	}
+	if histogram := readMetric(t, latency.WithLabelValues("200", "get", "/users").(prometheus.Metric)).GetHistogram(); histogram.GetSampleCount() != 1 {
+		t.Errorf("provided latency count = %v, want 1", histogram.GetSampleCount())
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == requestName || family.GetName() == latencyName {
+			t.Errorf("%s was registered along with the provided collectors", family.GetName())
+		}
+		if family.GetName() == "stack_requests_total" && len(family.GetMetric()) != 1 {
+			t.Errorf("provided counter has %d series, want 1", len(family.GetMetric()))
+		}
+	}
+}
+
+func Test_ProvidedCollectorsLabelMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "stack_requests_total"}, []string{"code", "path"})
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:    []prometheus.Registerer{prometheus.NewRegistry()},
+		Logger:         log.New(&buf, "", 0),
+		RequestCounter: requests,
+	})
+
+	if middleware.request == requests {
+		t.Error("counter with other label names was used")
+	}
+	if !strings.HasPrefix(buf.String(), "prometheusMiddleware RequestCounter was not used:") {
+		t.Errorf("logged %q, want the label mismatch", buf.String())
+	}
+}
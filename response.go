@@ -0,0 +1,67 @@
+package prometheusmiddleware
+
+import "net/http"
+
+// CapturedResponse is the response written by the handler, as captured by the middleware.
+type CapturedResponse interface {
+	// Status returns the status code written by the handler, which is 200 when the handler
+	// wrote nothing, as net/http then responds 200.
+	Status() int
+	// Header returns the header of the response, including the trailers set by the handler.
+	Header() http.Header
+	// Written returns how many bytes of the response body were written.
+	Written() int64
+	// Tail returns the last Opts.ResponseTailSize bytes of the response body, like the
+	// trailer frame of a gRPC-Web response. It is only valid until the recording returns.
+	Tail() []byte
+}
+
+// ResponseRecorder is a ResponseWriter which records the status and size of the response,
+// as returned by Opts.WrapResponseWriter.
+type ResponseRecorder interface {
+	http.ResponseWriter
+	// Status returns the status code written, or 0 when none was.
+	Status() int
+	// BytesWritten returns how many bytes of the response body were written.
+	BytesWritten() int64
+}
+
+// recordedBy takes the status and size of the response from the recorder the handler wrote to.
+func (r *responseWriterDelegator) recordedBy(recorder ResponseRecorder) {
+	if status := recorder.Status(); status != 0 {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.written = recorder.BytesWritten()
+	if r.measureHeader {
+		r.headerSize = headerSize(recorder.Header())
+	}
+}
+
+func (r *responseWriterDelegator) Status() int {
+	if !r.wroteHeader && !r.hijacked {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func (r *responseWriterDelegator) Written() int64 {
+	return r.written
+}
+
+func (r *responseWriterDelegator) Tail() []byte {
+	return r.tail
+}
+
+// captureTail keeps the last tailSize bytes written in the tail.
+func (r *responseWriterDelegator) captureTail(b []byte) {
+	if len(b) >= r.tailSize {
+		r.tail = append(r.tail[:0], b[len(b)-r.tailSize:]...)
+		return
+	}
+
+	if overflow := len(r.tail) + len(b) - r.tailSize; overflow > 0 {
+		r.tail = append(r.tail[:0], r.tail[overflow:]...)
+	}
+	r.tail = append(r.tail, b...)
+}
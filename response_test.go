@@ -0,0 +1,155 @@
+package prometheusmiddleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_captureTail(t *testing.T) {
+	delegate := &responseWriterDelegator{ResponseWriter: httptest.NewRecorder(), tailSize: 4}
+
+	for _, write := range []string{"ab", "cd", "e", "fghij", "k"} {
+		_, _ = delegate.Write([]byte(write))
+	}
+
+	if got := string(delegate.Tail()); got != "hijk" {
+		t.Errorf("Tail() = %q, want %q", got, "hijk")
+	}
+}
+
+// grpcWebStatus returns the grpc-status of the trailer frame ending the response.
+func grpcWebStatus(response CapturedResponse) string {
+	tail := response.Tail()
+	if i := bytes.LastIndexByte(tail, 0x80); i >= 0 {
+		for _, line := range strings.Split(string(tail[i+5:]), "\r\n") {
+			if strings.HasPrefix(line, "grpc-status:") {
+				return strings.TrimPrefix(line, "grpc-status:")
+			}
+		}
+	}
+	return "unknown"
+}
+
+func Test_InstrumentStatusFromResponse(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:        []prometheus.Registerer{prometheus.NewRegistry()},
+		StatusFromResponse: grpcWebStatus,
+		ResponseTailSize:   64,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/grpc.Service/Method", func(w http.ResponseWriter, r *http.Request) {
+		trailer := []byte("grpc-status:14\r\ngrpc-message:unavailable\r\n")
+		frame := make([]byte, 5, 5+len(trailer))
+		frame[0] = 0x80
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(trailer)))
+
+		w.Header().Set("Content-Type", "application/grpc-web+proto")
+		_, _ = w.Write(append(frame, trailer...))
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/grpc.Service/Method", nil))
+
+	got := readMetric(t, middleware.request.WithLabelValues("14", "post", "/grpc.Service/Method")).GetCounter().GetValue()
+	if got != 1 {
+		t.Errorf("requests with grpc-status 14 = %v, want 1", got)
+	}
+}
+
+// trackingWriter is an application ResponseWriter tracking the status and size of the response.
+type trackingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *trackingWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *trackingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *trackingWriter) Status() int         { return w.status }
+func (w *trackingWriter) BytesWritten() int64 { return w.written }
+
+func Test_InstrumentWrapResponseWriter(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		WrapResponseWriter: func(w http.ResponseWriter) ResponseRecorder {
+			return &trackingWriter{ResponseWriter: w}
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(*trackingWriter); !ok {
+			t.Errorf("handler got a %T, want the *trackingWriter", w)
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+
+	if got := readMetric(t, middleware.request.WithLabelValues("201", "post", "/")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests = %v, want 1", got)
+	}
+	histogram := readMetric(t, middleware.resSize.WithLabelValues("201", "post", "/").(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleSum() != 7 {
+		t.Errorf("response size = %v, want 7", histogram.GetSampleSum())
+	}
+}
+
+// timedOutWriter fails the writes of the body like net/http once the WriteTimeout of the server fired.
+type timedOutWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w timedOutWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("i/o timeout")
+}
+
+func Test_InstrumentTruncatedResponses(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:             []prometheus.Registerer{prometheus.NewRegistry()},
+		CountTruncatedResponses: true,
+		TruncatedStatus:         http.StatusGatewayTimeout,
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("a large report"))
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(timedOutWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/report", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/report", nil))
+
+	if got := readMetric(t, middleware.truncated.WithLabelValues("/report")).GetCounter().GetValue(); got != 1 {
+		t.Errorf("truncated responses = %v, want 1", got)
+	}
+	for code, want := range map[string]float64{"504": 1, "200": 1} {
+		if got := readMetric(t, middleware.request.WithLabelValues(code, "get", "/report")).GetCounter().GetValue(); got != want {
+			t.Errorf("%s requests = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package prometheusmiddleware
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+type enqueueTimeKey struct{}
+
+// enqueueTime is when a request was ready to be served, taken by the first request reading it:
+// the requests of a connection sharing its context, only the first one follows the accept.
+type enqueueTime struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// ContextWithEnqueueTime returns a copy of ctx holding t as the time the request was ready to be
+// served, e.g. when its connection was accepted. With Opts.TrackSchedulingDelay, the first request
+// served with the context observes the delay between t and the start of the middleware.
+func ContextWithEnqueueTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, enqueueTimeKey{}, &enqueueTime{t: t})
+}
+
+// ConnContext is a net/http.Server ConnContext holding the time each connection is accepted,
+// so that the first request of the connection observes the delay since the accept:
+//
+//	server := &http.Server{Handler: router, ConnContext: ConnContext}
+//
+// The delay includes the TLS handshake and the time the client took to send its first request,
+// not only the time the request waited for the CPU. The accept time is read from time.Now, use
+// the ConnContext method of the middleware when Opts.Now is another clock.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return ContextWithEnqueueTime(ctx, time.Now())
+}
+
+// ConnContext is the ConnContext function reading the accept time from Opts.Now, the clock
+// of the start of the middleware:
+//
+//	server := &http.Server{Handler: router, ConnContext: middleware.ConnContext}
+func (p *PrometheusMiddleware) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return ContextWithEnqueueTime(ctx, p.opts.Now())
+}
+
+// schedulingDelay returns how long after its enqueue time the request started at start, taking the
+// enqueue time, or -1 when the context holds none or it was already taken.
+func schedulingDelay(ctx context.Context, start time.Time) time.Duration {
+	enqueued, ok := ctx.Value(enqueueTimeKey{}).(*enqueueTime)
+	if !ok {
+		return -1
+	}
+
+	enqueued.mu.Lock()
+	t := enqueued.t
+	enqueued.t = time.Time{}
+	enqueued.mu.Unlock()
+
+	if t.IsZero() {
+		return -1
+	}
+	if delay := start.Sub(t); delay > 0 {
+		return delay
+	}
+	return 0
+}
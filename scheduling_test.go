@@ -0,0 +1,78 @@
+package prometheusmiddleware
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_InstrumentSchedulingDelay(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := begin
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Now: func() time.Time {
+			now = now.Add(3 * time.Millisecond)
+			return now
+		},
+		TrackSchedulingDelay: true,
+	})
+	handler := middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Both requests share the context of their connection, accepted at begin.
+	ctx := ContextWithEnqueueTime(context.Background(), begin)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	histogram := readMetric(t, middleware.delay).GetHistogram()
+	if histogram.GetSampleCount() != 1 || histogram.GetSampleSum() != 0.003 {
+		t.Errorf("scheduling delay = %d observations summing to %v, want 1 of 0.003",
+			histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+}
+
+func Test_ConnContext(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:          []prometheus.Registerer{prometheus.NewRegistry()},
+		PathLabelFunc:        func(r *http.Request) string { return "/" },
+		TrackSchedulingDelay: true,
+	})
+
+	server := httptest.NewUnstartedServer(middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	server.Config.ConnContext = ConnContext
+	server.Start()
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		res, err := server.Client().Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	if count := readMetric(t, middleware.delay).GetHistogram().GetSampleCount(); count != 1 {
+		t.Errorf("scheduling delay observations of a keep-alive connection = %d, want 1", count)
+	}
+}
+
+func Test_MiddlewareConnContext(t *testing.T) {
+	begin := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:          []prometheus.Registerer{prometheus.NewRegistry()},
+		Now:                  fakeClock(begin),
+		TrackSchedulingDelay: true,
+	})
+
+	ctx := middleware.ConnContext(context.Background(), nil)
+	if got := schedulingDelay(ctx, begin.Add(5*time.Millisecond)); got != 5*time.Millisecond {
+		t.Errorf("delay since the accept = %v, want 5ms from Opts.Now", got)
+	}
+}
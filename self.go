@@ -0,0 +1,81 @@
+package prometheusmiddleware
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// selfSubsystem is the subsystem of the metrics about the middleware itself.
+const selfSubsystem = "prometheus_middleware"
+
+// selfMetrics counts what the middleware lost or failed to do, exposed by Opts.SelfMetrics.
+// Its methods are no-ops on a nil *selfMetrics, so callers need not check whether it is enabled.
+type selfMetrics struct {
+	dropped            int64
+	droppedLogs        int64
+	overflows          int64
+	registrationErrors int64
+
+	droppedDesc            *prometheus.Desc
+	droppedLogsDesc        *prometheus.Desc
+	overflowsDesc          *prometheus.Desc
+	registrationErrorsDesc *prometheus.Desc
+}
+
+func newSelfMetrics(opts Opts) *selfMetrics {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, selfSubsystem, name), help, nil, opts.ConstLabels)
+	}
+
+	return &selfMetrics{
+		droppedDesc:            desc("dropped_observations_total", "How many request observations were dropped, e.g. because the async buffer was full."),
+		droppedLogsDesc:        desc("dropped_slow_request_logs_total", "How many slow request lines were not logged because the logging buffer was full."),
+		overflowsDesc:          desc("path_overflow_total", "How many requests had their path collapsed into \"overflow\" by MaxDistinctPaths."),
+		registrationErrorsDesc: desc("registration_errors_total", "How many collectors of the middleware failed to register."),
+	}
+}
+
+// drop counts a dropped observation.
+func (s *selfMetrics) drop() {
+	if s != nil {
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// dropLog counts a slow request line which was not logged.
+func (s *selfMetrics) dropLog() {
+	if s != nil {
+		atomic.AddInt64(&s.droppedLogs, 1)
+	}
+}
+
+// overflow counts a path collapsed into overflowPath.
+func (s *selfMetrics) overflow() {
+	if s != nil {
+		atomic.AddInt64(&s.overflows, 1)
+	}
+}
+
+// registrationError counts a failed registration of a collector.
+func (s *selfMetrics) registrationError() {
+	if s != nil {
+		atomic.AddInt64(&s.registrationErrors, 1)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *selfMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.droppedDesc
+	ch <- s.droppedLogsDesc
+	ch <- s.overflowsDesc
+	ch <- s.registrationErrorsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *selfMetrics) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(s.droppedDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&s.dropped)))
+	ch <- prometheus.MustNewConstMetric(s.droppedLogsDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&s.droppedLogs)))
+	ch <- prometheus.MustNewConstMetric(s.overflowsDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&s.overflows)))
+	ch <- prometheus.MustNewConstMetric(s.registrationErrorsDesc, prometheus.CounterValue, float64(atomic.LoadInt64(&s.registrationErrors)))
+}
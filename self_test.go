@@ -0,0 +1,67 @@
+package prometheusmiddleware
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_SelfMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	// Take the name of the request counter, so that the middleware fails to register it.
+	registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: requestName, Help: "Taken."}))
+
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{registry},
+		SelfMetrics:      true,
+		MaxDistinctPaths: 1,
+		Logger:           log.New(ioutil.Discard, "", 0),
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.HandleFunc("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/1", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/2", nil))
+	middleware.self.drop()
+	middleware.self.dropLog()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			got[family.GetName()] = metric.GetCounter().GetValue()
+		}
+	}
+
+	want := map[string]float64{
+		"prometheus_middleware_dropped_observations_total":      1,
+		"prometheus_middleware_dropped_slow_request_logs_total": 1,
+		"prometheus_middleware_path_overflow_total":             2,
+		"prometheus_middleware_registration_errors_total":       1,
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v, want %v", name, got[name], value)
+		}
+	}
+}
+
+func Test_selfMetricsDisabled(t *testing.T) {
+	var self *selfMetrics
+	self.drop()
+	self.dropLog()
+	self.overflow()
+	self.registrationError()
+}
@@ -0,0 +1,32 @@
+package prometheusmiddleware
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// dflMetricsPath is the path of the metrics endpoint mounted by Setup.
+const dflMetricsPath = "/metrics"
+
+// Setup creates a PrometheusMiddleware instrumenting the router, and mounts the metrics
+// endpoint on it at Opts.MetricsPath. The endpoint exposes the first of Opts.Registerers
+// which is also a prometheus.Gatherer, like a *prometheus.Registry, or the default gatherer.
+func Setup(router *mux.Router, opts Opts) *PrometheusMiddleware {
+	if opts.MetricsPath == "" {
+		opts.MetricsPath = dflMetricsPath
+	}
+
+	gatherer := prometheus.DefaultGatherer
+	for _, registerer := range opts.Registerers {
+		if g, ok := registerer.(prometheus.Gatherer); ok {
+			gatherer = g
+			break
+		}
+	}
+
+	middleware := NewPrometheusMiddleware(opts)
+	router.Use(middleware.InstrumentHandlerDuration)
+	router.Handle(opts.MetricsPath, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	return middleware
+}
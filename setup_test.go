@@ -0,0 +1,31 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_Setup(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	middleware := Setup(r, Opts{Registerers: []prometheus.Registerer{registry}, MetricsPath: "/internal/metrics"})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/internal/metrics", nil))
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/internal/metrics", nil))
+
+	if body := recorder.Body.String(); !strings.Contains(body, `http_requests_total{code="200",method="get",path="/users/{id}"} 1`) {
+		t.Errorf("metrics endpoint does not expose the request of /users/{id}:\n%s", body)
+	}
+	if got := readMetric(t, middleware.request.WithLabelValues("200", "get", "/internal/metrics")).GetCounter().GetValue(); got != 0 {
+		t.Errorf("scrapes instrumented = %v, want 0", got)
+	}
+}
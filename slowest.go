@@ -0,0 +1,56 @@
+package prometheusmiddleware
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// slowestCollector exposes the maximum latency observed per path since the previous scrape.
+type slowestCollector struct {
+	desc  *prometheus.Desc
+	paths sync.Map // path label -> *uint64 holding the bits of the maximum latency
+}
+
+func newSlowestCollector(opts Opts) *slowestCollector {
+	return &slowestCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, opts.Subsystem, slowestName),
+			"The longest time it took to process a request since the previous scrape, partitioned by HTTP path.",
+			[]string{"path"},
+			opts.ConstLabels,
+		),
+	}
+}
+
+// observe records the latency of a request, keeping the maximum per path.
+func (c *slowestCollector) observe(path string, seconds float64) {
+	v, ok := c.paths.Load(path)
+	if !ok {
+		v, _ = c.paths.LoadOrStore(path, new(uint64))
+	}
+	max := v.(*uint64)
+
+	for {
+		old := atomic.LoadUint64(max)
+		if math.Float64frombits(old) >= seconds || atomic.CompareAndSwapUint64(max, old, math.Float64bits(seconds)) {
+			return
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *slowestCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector, resetting the maximums.
+func (c *slowestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.paths.Range(func(path, v interface{}) bool {
+		seconds := math.Float64frombits(atomic.SwapUint64(v.(*uint64), 0))
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, seconds, path.(string))
+		return true
+	})
+}
@@ -0,0 +1,47 @@
+package prometheusmiddleware
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_slowestCollector(t *testing.T) {
+	c := newSlowestCollector(Opts{})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+
+	c.observe("/users", 0.2)
+	c.observe("/users", 1.5)
+	c.observe("/users", 0.7)
+	c.observe("/orders", 0.1)
+
+	want := map[string]float64{"/users": 1.5, "/orders": 0.1}
+	if got := gatherSlowest(t, registry); len(got) != 2 || got["/users"] != want["/users"] || got["/orders"] != want["/orders"] {
+		t.Errorf("first scrape = %v, want %v", got, want)
+	}
+
+	c.observe("/orders", 0.3)
+
+	want = map[string]float64{"/users": 0, "/orders": 0.3}
+	if got := gatherSlowest(t, registry); len(got) != 2 || got["/users"] != want["/users"] || got["/orders"] != want["/orders"] {
+		t.Errorf("second scrape = %v, want %v", got, want)
+	}
+}
+
+func gatherSlowest(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slowest := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			slowest[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+	}
+	return slowest
+}
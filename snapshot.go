@@ -0,0 +1,95 @@
+package prometheusmiddleware
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Snapshot holds the aggregates of the metrics of the middleware at a point in time.
+type Snapshot struct {
+	// Requests is the number of requests recorded.
+	Requests uint64 `json:"requests"`
+	// RequestsByPath is the number of requests recorded per path label.
+	RequestsByPath map[string]uint64 `json:"requests_by_path"`
+	// Latency aggregates the durations of every request.
+	Latency LatencySnapshot `json:"latency"`
+	// LatencyByPath aggregates the durations of the requests per path label.
+	LatencyByPath map[string]LatencySnapshot `json:"latency_by_path"`
+}
+
+// LatencySnapshot aggregates the durations of requests.
+type LatencySnapshot struct {
+	// Count is the number of durations observed.
+	Count uint64 `json:"count"`
+	// Total is the sum of the durations observed.
+	Total time.Duration `json:"total"`
+	// Mean is the average of the durations observed, or 0 without any.
+	Mean time.Duration `json:"mean"`
+}
+
+func (l *LatencySnapshot) add(count uint64, sum float64) {
+	l.Count += count
+	l.Total += time.Duration(sum * float64(time.Second))
+	if l.Count > 0 {
+		l.Mean = l.Total / time.Duration(l.Count)
+	}
+}
+
+// Snapshot returns the current aggregates of the request counter and the latency histogram,
+// e.g. to serve them as JSON from a status endpoint. It reads the collectors of the middleware,
+// so it does not depend on a registry, and costs a walk over their series. The latency leaves out
+// streamed responses when Opts.SkipStreamingResponses is set. For quantiles and buckets, scrape
+// the metrics.
+func (p *PrometheusMiddleware) Snapshot() Snapshot {
+	snapshot := Snapshot{
+		RequestsByPath: make(map[string]uint64),
+		LatencyByPath:  make(map[string]LatencySnapshot),
+	}
+
+	for _, metric := range collect(p.request) {
+		count := uint64(metric.GetCounter().GetValue())
+		snapshot.Requests += count
+		snapshot.RequestsByPath[pathLabel(metric)] += count
+	}
+
+	for _, metric := range collect(p.latency) {
+		histogram := metric.GetHistogram()
+		snapshot.Latency.add(histogram.GetSampleCount(), histogram.GetSampleSum())
+
+		path := pathLabel(metric)
+		latency := snapshot.LatencyByPath[path]
+		latency.add(histogram.GetSampleCount(), histogram.GetSampleSum())
+		snapshot.LatencyByPath[path] = latency
+	}
+	return snapshot
+}
+
+// collect returns the current value of every series of the collector.
+func collect(collector prometheus.Collector) []*dto.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+
+	var metrics []*dto.Metric
+	for m := range ch {
+		metric := &dto.Metric{}
+		if err := m.Write(metric); err == nil {
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics
+}
+
+// pathLabel returns the value of the path label of the series.
+func pathLabel(metric *dto.Metric) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == "path" {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
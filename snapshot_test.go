@@ -0,0 +1,52 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_Snapshot(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers: []prometheus.Registerer{prometheus.NewRegistry()},
+		Now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/1", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/2", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/orders", nil))
+
+	snapshot := middleware.Snapshot()
+	if snapshot.Requests != 3 {
+		t.Errorf("requests = %d, want 3", snapshot.Requests)
+	}
+	if got := snapshot.RequestsByPath["/users/{id}"]; got != 2 {
+		t.Errorf("requests of /users/{id} = %d, want 2", got)
+	}
+	if got := snapshot.RequestsByPath["/orders"]; got != 1 {
+		t.Errorf("requests of /orders = %d, want 1", got)
+	}
+
+	want := LatencySnapshot{Count: 3, Total: 3 * time.Second, Mean: time.Second}
+	if snapshot.Latency != want {
+		t.Errorf("latency = %+v, want %+v", snapshot.Latency, want)
+	}
+	if got := snapshot.LatencyByPath["/users/{id}"]; got.Count != 2 {
+		t.Errorf("latency count of /users/{id} = %d, want 2", got.Count)
+	}
+}
@@ -0,0 +1,53 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// unknownPath is the path label of the requests for which no Opts.PathLabelSources yields a path.
+const unknownPath = "unknown"
+
+// PathSource returns the path label of a request, or "" to let the next source of
+// Opts.PathLabelSources resolve it. StdlibPatternPath is a PathSource.
+type PathSource func(r *http.Request) string
+
+// MuxRouteTemplate is a PathSource returning the template of the gorilla/mux route of the request,
+// e.g. "/users/{id}". It returns "" when the request is not served by a gorilla/mux route.
+func MuxRouteTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, _ := route.GetPathTemplate()
+	return template
+}
+
+// MuxRouteName is a PathSource returning the name of the gorilla/mux route of the request.
+// It returns "" when the request is not served by a gorilla/mux route or the route has no name.
+func MuxRouteName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	return route.GetName()
+}
+
+// ConstantPath returns a PathSource always returning path, to end Opts.PathLabelSources with
+// another fallback than "unknown".
+func ConstantPath(path string) PathSource {
+	return func(r *http.Request) string {
+		return path
+	}
+}
+
+// sourcePath returns the path of the first source yielding one, else unknownPath.
+func sourcePath(sources []PathSource, r *http.Request) string {
+	for _, source := range sources {
+		if path := source(r); path != "" {
+			return path
+		}
+	}
+	return unknownPath
+}
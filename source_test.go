@@ -0,0 +1,43 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_InstrumentPathLabelSources(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:      []prometheus.Registerer{prometheus.NewRegistry()},
+		PathLabelSources: []PathSource{MuxRouteName, MuxRouteTemplate},
+	})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {}).Name("user")
+	r.HandleFunc("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(middleware.InstrumentHandlerDuration)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/42", nil))
+	// Outside of a gorilla/mux router, no source yields a path.
+	middleware.InstrumentHandlerDuration(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/raw", nil))
+
+	for _, path := range []string{"user", "/orders/{id}"} {
+		if got := readMetric(t, middleware.request.WithLabelValues("200", "get", path)).GetCounter().GetValue(); got != 1 {
+			t.Errorf("requests of %q = %v, want 1", path, got)
+		}
+	}
+	if got := readMetric(t, middleware.request.WithLabelValues("404", "get", unknownPath)).GetCounter().GetValue(); got != 1 {
+		t.Errorf("requests of %q = %v, want 1", unknownPath, got)
+	}
+}
+
+func Test_sourcePathConstantFallback(t *testing.T) {
+	sources := []PathSource{MuxRouteTemplate, StdlibPatternPath, ConstantPath("other")}
+	if got := sourcePath(sources, httptest.NewRequest("GET", "/raw", nil)); got != "other" {
+		t.Errorf("sourcePath() = %q, want %q", got, "other")
+	}
+}
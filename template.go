@@ -0,0 +1,64 @@
+package prometheusmiddleware
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultAutoTemplatePatterns are the patterns templating the URL path when Opts.AutoTemplatePatterns is nil:
+// numeric segments become ":id" and UUID segments become ":uuid".
+var DefaultAutoTemplatePatterns = map[string]*regexp.Regexp{
+	"id":   regexp.MustCompile(`^[0-9]+$`),
+	"uuid": regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`),
+}
+
+// segmentTemplate replaces the path segments matching pattern by placeholder.
+type segmentTemplate struct {
+	placeholder string
+	pattern     *regexp.Regexp
+}
+
+// pathTemplater templates the URL path of the requests not served by a gorilla/mux route.
+type pathTemplater []segmentTemplate
+
+// newPathTemplater returns the templater of the URL paths, or nil when auto-templating is disabled.
+// The patterns are tried by name so that a segment matching several of them is templated consistently.
+func newPathTemplater(opts Opts) pathTemplater {
+	if opts.DisableAutoTemplate {
+		return nil
+	}
+
+	patterns := opts.AutoTemplatePatterns
+	if patterns == nil {
+		patterns = DefaultAutoTemplatePatterns
+	}
+
+	t := make(pathTemplater, 0, len(patterns))
+	for name, pattern := range patterns {
+		t = append(t, segmentTemplate{placeholder: ":" + name, pattern: pattern})
+	}
+	sort.Slice(t, func(i, j int) bool { return t[i].placeholder < t[j].placeholder })
+	return t
+}
+
+// template replaces every segment of path matching a pattern by the placeholder of the pattern.
+func (t pathTemplater) template(path string) string {
+	if len(t) == 0 {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		for _, st := range t {
+			if st.pattern.MatchString(segment) {
+				segments[i] = st.placeholder
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
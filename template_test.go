@@ -0,0 +1,48 @@
+package prometheusmiddleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_pathTemplater(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Opts
+		path string
+		want string
+	}{
+		{"default id", Opts{}, "/users/42/orders/7", "/users/:id/orders/:id"},
+		{"default uuid", Opts{}, "/sessions/3f2504e0-4f89-11d3-9a0c-0305e82c3301", "/sessions/:uuid"},
+		{"trailing slash", Opts{}, "/users/42/", "/users/:id/"},
+		{"untouched", Opts{}, "/users/me", "/users/me"},
+		{"custom", Opts{AutoTemplatePatterns: map[string]*regexp.Regexp{"sha": regexp.MustCompile(`^[0-9a-f]{40}$`)}},
+			"/commits/da39a3ee5e6b4b0d3255bfef95601890afd80709/42", "/commits/:sha/42"},
+		{"disabled", Opts{DisableAutoTemplate: true}, "/users/42", "/users/42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newPathTemplater(tt.opts).template(tt.path); got != tt.want {
+				t.Errorf("template(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_InstrumentWithoutRouter(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{Registerers: []prometheus.Registerer{prometheus.NewRegistry()}})
+	handler := middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users/42", nil))
+
+	got := readMetric(t, middleware.request.WithLabelValues("200", "get", "/users/:id")).GetCounter().GetValue()
+	if got != 1 {
+		t.Errorf("requests of /users/:id = %v, want 1", got)
+	}
+}
@@ -0,0 +1,27 @@
+package prometheusmiddleware
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// tlsVersion returns the bounded tls_version label of the request,
+// "none" for plaintext requests.
+func tlsVersion(r *http.Request) string {
+	if r.TLS == nil {
+		return "none"
+	}
+
+	switch r.TLS.Version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return "unknown"
+	}
+}
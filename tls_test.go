@@ -0,0 +1,53 @@
+package prometheusmiddleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_tlsVersion(t *testing.T) {
+	tests := []struct {
+		state *tls.ConnectionState
+		want  string
+	}{
+		{state: nil, want: "none"},
+		{state: &tls.ConnectionState{Version: tls.VersionTLS10}, want: "1.0"},
+		{state: &tls.ConnectionState{Version: tls.VersionTLS11}, want: "1.1"},
+		{state: &tls.ConnectionState{Version: tls.VersionTLS12}, want: "1.2"},
+		{state: &tls.ConnectionState{Version: tls.VersionTLS13}, want: "1.3"},
+		{state: &tls.ConnectionState{Version: tls.VersionSSL30}, want: "unknown"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = tt.state
+		if got := tlsVersion(r); got != tt.want {
+			t.Errorf("tlsVersion(%v) = %s, want %s", tt.state, got, tt.want)
+		}
+	}
+}
+
+func Test_InstrumentTLSResumptions(t *testing.T) {
+	middleware := NewPrometheusMiddleware(Opts{
+		Registerers:         []prometheus.Registerer{prometheus.NewRegistry()},
+		CountTLSResumptions: true,
+	})
+	handler := middleware.InstrumentHandlerDuration(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, state := range []*tls.ConnectionState{{DidResume: true}, {DidResume: false}, {DidResume: true}, nil} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = state
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if got := readMetric(t, middleware.tlsResumed).GetCounter().GetValue(); got != 2 {
+		t.Errorf("resumed = %v, want 2", got)
+	}
+	if got := readMetric(t, middleware.tlsFull).GetCounter().GetValue(); got != 1 {
+		t.Errorf("full handshakes = %v, want 1", got)
+	}
+}